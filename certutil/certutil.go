@@ -13,25 +13,39 @@ import (
 	"fmt"
 	"strings"
 
-	"github.com/twmb/algoimpl/go/graph"
-	"golang.org/x/crypto/pkcs12"
+	log "github.com/sirupsen/logrus"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
-// Takes Base64 Encoded PKCS12 as String and produces PEM Encoded PCKS8 Private Key as String
-func PemPrivateKeyFromPkcs12(b64pkcs12 string) string {
-	p12, _ := base64.StdEncoding.DecodeString(b64pkcs12)
+var (
+	// The input was not valid base64
+	ErrInvalidEncoding = errors.New("invalid base64 encoding")
+	// The input could not be decoded as PKCS12
+	ErrInvalidPkcs12 = errors.New("invalid PKCS12 data")
+	// No private key was found in the input
+	ErrNoPrivateKey = errors.New("no private key found")
+	// No certificate was found in the input
+	ErrNoCertificate = errors.New("no certificate found")
+	// A certificate or key block could not be parsed
+	ErrInvalidPem = errors.New("invalid PEM data")
+	// The private key is of a type other than RSA, ECDSA or Ed25519
+	ErrUnsupportedKeyType = errors.New("unsupported private key type")
+	// The password given for PKCS12 data was wrong
+	ErrIncorrectPassword = errors.New("incorrect PKCS12 password")
+)
 
-	// Get the PEM Blocks
-	blocks, err := pkcs12.ToPEM(p12, "")
+// Takes Base64 Encoded PKCS12 as String and produces PEM Encoded PCKS8 Private Key as String
+func PemPrivateKeyFromPkcs12(b64pkcs12 string, password string) (string, error) {
+	blocks, err := pkcs12ToPemBlocks(b64pkcs12, password)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	return findPrivateKeyInPemBlocks(blocks)
 }
 
 // Takes PEM Encoded data as String and produces PEM Encoded PCKS8 Private Key as String
-func PemPrivateKeyFromPem(data string) string {
+func PemPrivateKeyFromPem(data string) (string, error) {
 	// Convert string to Pem Blocks
 	blocks := stringToPemBlocks(data)
 	// Find the Private Key from these blocks
@@ -39,20 +53,17 @@ func PemPrivateKeyFromPem(data string) string {
 }
 
 // Takes Base64 Encoded PKCS12 as String and produces PEM Encoded x509 Certificate as String
-func PemCertFromPkcs12(b64pkcs12 string) string {
-	p12, _ := base64.StdEncoding.DecodeString(b64pkcs12)
-
-	// Get the PEM Blocks
-	blocks, err := pkcs12.ToPEM(p12, "")
+func PemCertFromPkcs12(b64pkcs12 string, password string) (string, error) {
+	blocks, err := pkcs12ToPemBlocks(b64pkcs12, password)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 	// Find the Certificate from these blocks
 	return findLeafCertInPemBlocks(blocks)
 }
 
 // Takes PEM Encoded data as String and produces PEM Encoded x509 Certificate as String
-func PemCertFromPem(data string) string {
+func PemCertFromPem(data string) (string, error) {
 	// Convert string to pem blocks
 	blocks := stringToPemBlocks(data)
 	// Find the Certificate from these blocks
@@ -60,76 +71,75 @@ func PemCertFromPem(data string) string {
 }
 
 // Takes DER Encoded Byte Array and produces PEM Encoded x509 Certificate as String
-func PemCertFromBytes(derBytes []byte) string {
+func PemCertFromBytes(derBytes []byte) (string, error) {
+	if len(derBytes) == 0 {
+		return "", ErrNoCertificate
+	}
+
 	// Encode just the leaf cert as pem
 	var certPem bytes.Buffer
 	if err := pem.Encode(&certPem, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
-		panic(fmt.Sprintf("Failed to write data: %s", err))
+		return "", fmt.Errorf("failed to write data: %w", err)
 	}
 
-	return certPem.String()
+	return certPem.String(), nil
 }
 
 // Takes Base64 Encoded PKCS12 as String and produces PEM Encoded x509 Certificate Chain as String
-func PemChainFromPkcs12(b64pkcs12 string, justIssuers bool) string {
-	p12, _ := base64.StdEncoding.DecodeString(b64pkcs12)
-
-	// Get the PEM Blocks
-	blocks, err := pkcs12.ToPEM(p12, "")
+func PemChainFromPkcs12(b64pkcs12 string, password string, justIssuers bool, completer *ChainCompleter) (string, error) {
+	blocks, err := pkcs12ToPemBlocks(b64pkcs12, password)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 	// Find the Certificate chain  from these blocks
-	return findChainInPemBlocks(blocks, justIssuers)
+	return findChainInPemBlocks(blocks, justIssuers, completer)
 }
 
 // Takes PEM Encoded data as String and produces PEM Encoded x509 Certificate Chain as String
-func PemChainFromPem(data string, justIssuers bool) string {
+func PemChainFromPem(data string, justIssuers bool, completer *ChainCompleter) (string, error) {
 	// Get the PEM blocks from the string
 	blocks := stringToPemBlocks(data)
 
 	// Find the Certificate chain  from these blocks
-	return findChainInPemBlocks(blocks, justIssuers)
+	return findChainInPemBlocks(blocks, justIssuers, completer)
 }
 
-// Sorts an array of x509.Certificate objects
-func SortedChain(certs []*x509.Certificate, justIssuers bool) []x509.Certificate {
-	g := graph.New(graph.Directed)
+// Decodes Base64 Encoded PKCS12 into an array of pem.Block. An empty password also matches files without one
+func pkcs12ToPemBlocks(b64pkcs12 string, password string) ([]*pem.Block, error) {
+	p12, err := base64.StdEncoding.DecodeString(b64pkcs12)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
 
-	// Make a graph where each node represents a certificate and the key is its subject key identifier
-	certGraph := make(map[string]graph.Node, 0)
+	// DecodeChain handles PBES2/AES encryption and any number of certificates, but needs a private key
+	key, leaf, caCerts, err := pkcs12.DecodeChain(p12, password)
+	if err != nil {
+		if errors.Is(err, pkcs12.ErrIncorrectPassword) {
+			return nil, ErrIncorrectPassword
+		}
 
-	// For each cert make a graph node
-	for _, cert := range certs {
-		certGraph[string(cert.SubjectKeyId)] = g.MakeNode()
-		*certGraph[string(cert.SubjectKeyId)].Value = *cert
+		// Fall back to converting every bag, for files that only hold certificates
+		blocks, toPemErr := pkcs12.ToPEM(p12, password)
+		if toPemErr != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPkcs12, err)
+		}
+		return blocks, nil
 	}
 
-	// Make the edges of the graph from child cert to issuer
-	for _, node := range certGraph {
-		cert := (*node.Value).(x509.Certificate)
-		g.MakeEdge(certGraph[string(cert.SubjectKeyId)], certGraph[string(cert.AuthorityKeyId)])
+	privBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedKeyType, err)
 	}
 
-	// Sort the graph
-	sorted := g.TopologicalSort()
-	var sortedCerts []x509.Certificate
-
-	for i := range sorted {
-		cert := (*sorted[i].Value).(x509.Certificate)
-		sortedCerts = append(sortedCerts, cert)
+	blocks := []*pem.Block{
+		{Type: "PRIVATE KEY", Bytes: privBytes},
+		{Type: "CERTIFICATE", Bytes: leaf.Raw},
 	}
-
-	if justIssuers {
-		// If we only have the leaf cert there are no issuers to return
-		if len(sortedCerts) <= 1 {
-			return nil
-		} else {
-			return sortedCerts[1:]
-		}
+	for _, cert := range caCerts {
+		blocks = append(blocks, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
 	}
 
-	return sortedCerts
+	return blocks, nil
 }
 
 // Attempts to turn String data into array of pem.Block
@@ -149,7 +159,7 @@ func stringToPemBlocks(data string) []*pem.Block {
 }
 
 // Attempts to find Private key in array of pem.Block and return it as PEM Encoded PKCS8 String
-func findPrivateKeyInPemBlocks(blocks []*pem.Block) string {
+func findPrivateKeyInPemBlocks(blocks []*pem.Block) (string, error) {
 	var keyBuffer bytes.Buffer
 	//Find the private key from all the blocks
 	for _, block := range blocks {
@@ -157,23 +167,23 @@ func findPrivateKeyInPemBlocks(blocks []*pem.Block) string {
 		if block.Type == "PRIVATE KEY" || strings.HasSuffix(block.Type, " PRIVATE KEY") {
 			key, err := parsePrivateKey(block.Bytes)
 			if err != nil {
-				panic(err)
+				return "", err
 			}
 
 			// Force it to pkcs8 for consistency
 			privBytes, err := x509.MarshalPKCS8PrivateKey(key)
 			if err != nil {
-				panic(err)
+				return "", fmt.Errorf("%w: %v", ErrUnsupportedKeyType, err)
 			}
 
 			// Encode the pkcs8 object as PEM
 			if err := pem.Encode(&keyBuffer, &pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}); err != nil {
-				panic(fmt.Sprintf("Failed to write data: %s", err))
+				return "", fmt.Errorf("failed to write data: %w", err)
 			}
-			break
+			return keyBuffer.String(), nil
 		}
 	}
-	return keyBuffer.String()
+	return "", ErrNoPrivateKey
 }
 
 // https://golang.org/src/crypto/tls/tls.go?#L370
@@ -187,7 +197,7 @@ func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
 		case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
 			return key, nil
 		default:
-			return nil, errors.New("tls: found unknown private key type in PKCS#8 wrapping")
+			return nil, fmt.Errorf("%w: %T in PKCS#8 wrapping", ErrUnsupportedKeyType, key)
 		}
 	}
 
@@ -195,53 +205,62 @@ func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
 		return key, nil
 	}
 
-	return nil, errors.New("tls: failed to parse private key")
+	return nil, fmt.Errorf("%w: failed to parse private key", ErrInvalidPem)
 }
 
-// Attempts to find leaf certificate in array of pem.Block data and return as PEM Encoded x509 Certificate
-func findLeafCertInPemBlocks(blocks []*pem.Block) string {
+// Attempts to find all the certificates in array of pem.Block
+func findCertsInPemBlocks(blocks []*pem.Block) ([]*x509.Certificate, error) {
 	var certs []*x509.Certificate
 	//Find all the Certificate blocks
 	for _, block := range blocks {
-		// Private Key?
+		// Certificate?
 		if block.Type == "CERTIFICATE" {
 			cert, err := x509.ParseCertificate(block.Bytes)
-
 			if err != nil {
-				panic(err)
+				return nil, fmt.Errorf("%w: %v", ErrInvalidPem, err)
 			}
 
 			certs = append(certs, cert)
 		}
 	}
 
+	if len(certs) == 0 {
+		return nil, ErrNoCertificate
+	}
+
+	return certs, nil
+}
+
+// Attempts to find leaf certificate in array of pem.Block data and return as PEM Encoded x509 Certificate
+func findLeafCertInPemBlocks(blocks []*pem.Block) (string, error) {
+	certs, err := findCertsInPemBlocks(blocks)
+	if err != nil {
+		return "", err
+	}
+
 	// Sort the certs
 	sortedCerts := SortedChain(certs, false)
 
 	// PEM Encode first cert in sortedCerts
 	var certBuffer bytes.Buffer
 	if err := pem.Encode(&certBuffer, &pem.Block{Type: "CERTIFICATE", Bytes: sortedCerts[0].Raw}); err != nil {
-		panic(fmt.Sprintf("Failed to write data: %s", err))
+		return "", fmt.Errorf("failed to write data: %w", err)
 	}
 
-	return certBuffer.String()
+	return certBuffer.String(), nil
 }
 
 // Attempts to find chain in array of pem.Block and return as PEM Encoded Sorted Chain of x509 Certificates
-func findChainInPemBlocks(blocks []*pem.Block, justIssuers bool) string {
-	var certs []*x509.Certificate
-	//Find all the Certificate blocks
-	for _, block := range blocks {
-		// Certificate?
-		if block.Type == "CERTIFICATE" {
-			cert, err := x509.ParseCertificate(block.Bytes)
-
-			if err != nil {
-				panic(err)
-			}
+func findChainInPemBlocks(blocks []*pem.Block, justIssuers bool, completer *ChainCompleter) (string, error) {
+	certs, err := findCertsInPemBlocks(blocks)
+	if err != nil {
+		return "", err
+	}
 
-			certs = append(certs, cert)
-		}
+	// Add any missing issuers. An incomplete chain is still better than no chain, so only warn
+	certs, err = completer.Complete(certs)
+	if err != nil {
+		log.Printf("Could not complete certificate chain: %v", err)
 	}
 
 	// Sort the certs
@@ -251,9 +270,9 @@ func findChainInPemBlocks(blocks []*pem.Block, justIssuers bool) string {
 	var certBuffer bytes.Buffer
 	for i := range sortedCerts {
 		if err := pem.Encode(&certBuffer, &pem.Block{Type: "CERTIFICATE", Bytes: sortedCerts[i].Raw}); err != nil {
-			panic(fmt.Sprintf("Failed to write data: %s", err))
+			return "", fmt.Errorf("failed to write data: %w", err)
 		}
 	}
 
-	return certBuffer.String()
+	return certBuffer.String(), nil
 }
@@ -0,0 +1,214 @@
+package certutil
+
+import (
+	"bytes"
+	"crypto/x509"
+	"time"
+)
+
+// Sorts an array of x509.Certificate objects into a chain, starting with the leaf and ending with the root
+// (or the last issuer present). Certificates are linked by subject and authority key identifiers where both
+// are present, falling back to matching subject and issuer names, and a link is only made if the issuer's
+// signature verifies. When several paths are possible, one ending in a self-signed root is preferred, then
+// one without expired certificates, then the shortest. Certificates that aren't on the chosen path follow it,
+// in the order they were given.
+func SortedChain(certs []*x509.Certificate, justIssuers bool) []x509.Certificate {
+	path, others := chainPath(certs)
+
+	var sortedCerts []x509.Certificate
+	for _, cert := range append(path, others...) {
+		sortedCerts = append(sortedCerts, *cert)
+	}
+
+	if justIssuers {
+		// If we only have the leaf cert there are no issuers to return
+		if len(sortedCerts) <= 1 {
+			return nil
+		} else {
+			return sortedCerts[1:]
+		}
+	}
+
+	return sortedCerts
+}
+
+// Picks the best path from a leaf towards a root as described for SortedChain, returning it along with the
+// certificates that aren't on it
+func chainPath(certs []*x509.Certificate) (path []*x509.Certificate, others []*x509.Certificate) {
+	certs = uniqueCerts(certs)
+	if len(certs) == 0 {
+		return nil, nil
+	}
+
+	// Work out every possible issuer of each certificate up front
+	issuers := make([][]int, len(certs))
+	issuesOthers := make([]bool, len(certs))
+	for i, child := range certs {
+		for j, parent := range certs {
+			if i != j && isIssuedBy(child, parent) {
+				issuers[i] = append(issuers[i], j)
+				issuesOthers[j] = true
+			}
+		}
+	}
+
+	var best []int
+	memo := make(map[int][]int)
+	for _, leaf := range leafCandidates(certs, issuesOthers) {
+		candidate, _ := bestPath(certs, issuers, leaf, map[int]bool{}, memo)
+		if best == nil || betterPath(certs, candidate, best) {
+			best = candidate
+		}
+	}
+
+	onPath := make(map[int]bool)
+	for _, i := range best {
+		path = append(path, certs[i])
+		onPath[i] = true
+	}
+	for i, cert := range certs {
+		if !onPath[i] {
+			others = append(others, cert)
+		}
+	}
+
+	return path, others
+}
+
+// Drops repeated copies of the same certificate, keeping the first
+func uniqueCerts(certs []*x509.Certificate) []*x509.Certificate {
+	var results []*x509.Certificate
+	for _, cert := range certs {
+		duplicate := false
+		for _, seen := range results {
+			if cert.Equal(seen) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			results = append(results, cert)
+		}
+	}
+	return results
+}
+
+// Leaves are the certificates that didn't issue any of the others. Non-CA certificates are tried first,
+// and if every certificate issued another (e.g. a set of cross-signed CAs) all of them are candidates.
+// A self-signed certificate that issued nothing is a stray root, so it is only a leaf if nothing else is
+func leafCandidates(certs []*x509.Certificate, issuesOthers []bool) []int {
+	var endEntities, cas, strays []int
+	for i, cert := range certs {
+		if issuesOthers[i] {
+			continue
+		}
+		if isSelfSigned(cert) {
+			strays = append(strays, i)
+		} else if cert.IsCA {
+			cas = append(cas, i)
+		} else {
+			endEntities = append(endEntities, i)
+		}
+	}
+
+	if len(endEntities) > 0 {
+		return endEntities
+	}
+	if len(cas) > 0 {
+		return cas
+	}
+	if len(strays) > 0 {
+		return strays
+	}
+
+	var all []int
+	for i := range certs {
+		all = append(all, i)
+	}
+	return all
+}
+
+// Walks every path from the certificate at index i towards a root, never revisiting a certificate so
+// cross-signatures can't loop, and returns the best one. Paths end at the first self-signed root. A path that didn't have to
+// skip a visited certificate is the best from i whatever led there, so it is kept in memo and reused
+// instead of walking the same issuers again. reusable reports whether the path was memoised
+func bestPath(certs []*x509.Certificate, issuers [][]int, i int, visited map[int]bool, memo map[int][]int) (path []int, reusable bool) {
+	if path, ok := memo[i]; ok {
+		return path, true
+	}
+	if isSelfSigned(certs[i]) {
+		return []int{i}, true
+	}
+
+	visited[i] = true
+	defer delete(visited, i)
+
+	var best []int
+	reusable = true
+	for _, parent := range issuers[i] {
+		if visited[parent] {
+			reusable = false
+			continue
+		}
+		path, parentReusable := bestPath(certs, issuers, parent, visited, memo)
+		reusable = reusable && parentReusable
+		if best == nil || betterPath(certs, path, best) {
+			best = path
+		}
+	}
+
+	path = append([]int{i}, best...)
+	if reusable {
+		memo[i] = path
+	}
+	return path, reusable
+}
+
+// A path ending in a self-signed root beats one that doesn't, then one with fewer expired certificates,
+// then the shorter one. Otherwise the first path found is kept, so the result only depends on the order
+// the certificates were given in
+func betterPath(certs []*x509.Certificate, a []int, b []int) bool {
+	aRooted := isSelfSigned(certs[a[len(a)-1]])
+	bRooted := isSelfSigned(certs[b[len(b)-1]])
+	if aRooted != bRooted {
+		return aRooted
+	}
+
+	aExpired := expiredCount(certs, a)
+	bExpired := expiredCount(certs, b)
+	if aExpired != bExpired {
+		return aExpired < bExpired
+	}
+
+	return len(a) < len(b)
+}
+
+func expiredCount(certs []*x509.Certificate, path []int) int {
+	now := time.Now()
+	count := 0
+	for _, i := range path {
+		if now.After(certs[i].NotAfter) {
+			count++
+		}
+	}
+	return count
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return isIssuedBy(cert, cert)
+}
+
+// Checks whether parent issued child: the key identifiers must agree when both certificates have them,
+// otherwise the names must, and in either case parent's key must verify child's signature
+func isIssuedBy(child *x509.Certificate, parent *x509.Certificate) bool {
+	if len(child.AuthorityKeyId) > 0 && len(parent.SubjectKeyId) > 0 {
+		if !bytes.Equal(child.AuthorityKeyId, parent.SubjectKeyId) {
+			return false
+		}
+	} else if !bytes.Equal(child.RawIssuer, parent.RawSubject) {
+		return false
+	}
+
+	// CheckSignatureFrom would also insist on CA basic constraints, which some legacy internal CAs don't set
+	return parent.CheckSignature(child.SignatureAlgorithm, child.RawTBSCertificate, child.Signature) == nil
+}
@@ -0,0 +1,222 @@
+package certutil
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// A generated certificate and the key it was issued for
+type testCert struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+var testSerial int64
+
+// Issues a certificate for name, signed by parent or self-signed if parent is nil. key is reused when given,
+// so the same CA can be issued more than once (e.g. cross-signed). legacy certificates have no basic
+// constraints, and so no subject or authority key identifiers
+func issue(t *testing.T, name string, parent *testCert, key crypto.Signer, notAfter time.Time, legacy bool) *testCert {
+	t.Helper()
+
+	if key == nil {
+		var err error
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	if !legacy {
+		template.BasicConstraintsValid = true
+		template.IsCA = true
+	}
+
+	issuer, issuerKey := template, key
+	if parent != nil {
+		issuer, issuerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, key.Public(), issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert: cert, key: key}
+}
+
+func valid() time.Time {
+	return time.Now().Add(24 * time.Hour)
+}
+
+func certList(certs ...*testCert) []*x509.Certificate {
+	var results []*x509.Certificate
+	for _, c := range certs {
+		results = append(results, c.cert)
+	}
+	return results
+}
+
+// The chain as its common names, with the issuer's name for certificates sharing a subject
+func chainNames(chain []x509.Certificate) []string {
+	var names []string
+	for _, cert := range chain {
+		names = append(names, fmt.Sprintf("%v<%v", cert.Subject.CommonName, cert.Issuer.CommonName))
+	}
+	return names
+}
+
+func assertChain(t *testing.T, chain []x509.Certificate, want ...string) {
+	t.Helper()
+
+	got := chainNames(chain)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got chain %v, want %v", got, want)
+	}
+}
+
+func TestSortedChainOrdersShuffledCerts(t *testing.T) {
+	root := issue(t, "root", nil, nil, valid(), false)
+	intermediate := issue(t, "intermediate", root, nil, valid(), false)
+	leaf := issue(t, "leaf", intermediate, nil, valid(), false)
+
+	certs := certList(intermediate, root, leaf)
+	assertChain(t, SortedChain(certs, false), "leaf<intermediate", "intermediate<root", "root<root")
+	assertChain(t, SortedChain(certs, true), "intermediate<root", "root<root")
+}
+
+func TestSortedChainWithoutKeyIdentifiers(t *testing.T) {
+	root := issue(t, "root", nil, nil, valid(), true)
+	intermediate := issue(t, "intermediate", root, nil, valid(), true)
+	leaf := issue(t, "leaf", intermediate, nil, valid(), true)
+	for _, c := range []*testCert{root, intermediate, leaf} {
+		if len(c.cert.SubjectKeyId) > 0 || len(c.cert.AuthorityKeyId) > 0 {
+			t.Fatalf("%v unexpectedly has key identifiers", c.cert.Subject)
+		}
+	}
+
+	assertChain(t, SortedChain(certList(root, leaf, intermediate), false), "leaf<intermediate", "intermediate<root", "root<root")
+}
+
+func TestSortedChainDoesNotLinkUnverifiedNameMatches(t *testing.T) {
+	root := issue(t, "root", nil, nil, valid(), true)
+	leaf := issue(t, "leaf", root, nil, valid(), true)
+	// Same name as the real root, different key
+	impostor := issue(t, "root", nil, nil, valid(), true)
+
+	assertChain(t, SortedChain(certList(leaf, impostor, root), false), "leaf<root", "root<root", "root<root")
+	if chain := SortedChain(certList(leaf, impostor, root), false); !chain[1].Equal(root.cert) {
+		t.Fatalf("leaf was linked to a root that didn't sign it")
+	}
+}
+
+func TestSortedChainSelfSignedRoot(t *testing.T) {
+	root := issue(t, "root", nil, nil, valid(), false)
+
+	assertChain(t, SortedChain(certList(root), false), "root<root")
+	if chain := SortedChain(certList(root), true); chain != nil {
+		t.Fatalf("got issuers %v for a lone root", chainNames(chain))
+	}
+}
+
+func TestSortedChainCrossSignedIntermediate(t *testing.T) {
+	oldRoot := issue(t, "old root", nil, nil, valid(), false)
+	newRoot := issue(t, "new root", nil, nil, valid(), false)
+	viaOld := issue(t, "intermediate", oldRoot, nil, time.Now().Add(-time.Minute), false)
+	viaNew := issue(t, "intermediate", newRoot, viaOld.key, valid(), false)
+	leaf := issue(t, "leaf", viaNew, nil, valid(), false)
+
+	// The path through the expired cross-signature loses, whatever the order
+	certs := certList(viaOld, oldRoot, leaf, newRoot, viaNew)
+	assertChain(t, SortedChain(certs, false),
+		"leaf<intermediate", "intermediate<new root", "new root<new root", "intermediate<old root", "old root<old root")
+}
+
+func TestSortedChainPrefersRootedPath(t *testing.T) {
+	root := issue(t, "root", nil, nil, valid(), false)
+	otherRoot := issue(t, "other root", nil, nil, valid(), false)
+	rooted := issue(t, "intermediate", root, nil, valid(), false)
+	// Issued by a root that isn't present, so this path can't reach one
+	unrooted := issue(t, "intermediate", otherRoot, rooted.key, valid(), false)
+	leaf := issue(t, "leaf", rooted, nil, valid(), false)
+
+	assertChain(t, SortedChain(certList(leaf, unrooted, rooted, root), false),
+		"leaf<intermediate", "intermediate<root", "root<root", "intermediate<other root")
+}
+
+func TestSortedChainMutuallyCrossSignedRoots(t *testing.T) {
+	a := issue(t, "a", nil, nil, valid(), false)
+	b := issue(t, "b", nil, nil, valid(), false)
+	aByB := issue(t, "a", b, a.key, valid(), false)
+	bByA := issue(t, "b", a, b.key, valid(), false)
+	leaf := issue(t, "leaf", a, nil, valid(), false)
+
+	chain := SortedChain(certList(aByB, bByA, leaf, a, b), false)
+	assertChain(t, chain[:2], "leaf<a", "a<a")
+	if len(chain) != 5 {
+		t.Fatalf("got %v certificates, want all 5", len(chain))
+	}
+}
+
+func TestSortedChainKeepsUnrelatedCerts(t *testing.T) {
+	root := issue(t, "root", nil, nil, valid(), false)
+	intermediate := issue(t, "intermediate", root, nil, valid(), false)
+	leaf := issue(t, "leaf", intermediate, nil, valid(), false)
+	unrelated := issue(t, "unrelated", nil, nil, valid(), false)
+
+	certs := certList(leaf, unrelated, intermediate, root)
+	assertChain(t, SortedChain(certs, false), "leaf<intermediate", "intermediate<root", "root<root", "unrelated<unrelated")
+	assertChain(t, SortedChain(certs, true), "intermediate<root", "root<root", "unrelated<unrelated")
+}
+
+func TestSortedChainDropsDuplicates(t *testing.T) {
+	root := issue(t, "root", nil, nil, valid(), false)
+	leaf := issue(t, "leaf", root, nil, valid(), false)
+
+	assertChain(t, SortedChain(certList(leaf, root, leaf, root), false), "leaf<root", "root<root")
+}
+
+// Every level is issued twice, so there are 2^levels paths to the root. Walking each of them would not finish
+func TestSortedChainManyAlternativePaths(t *testing.T) {
+	const levels = 30
+
+	root := issue(t, "root", nil, nil, valid(), false)
+	parents := []*testCert{root}
+	certs := certList(root)
+	for level := 0; level < levels; level++ {
+		name := fmt.Sprintf("level %v", level)
+		first := issue(t, name, parents[0], nil, valid(), false)
+		second := issue(t, name, parents[len(parents)-1], first.key, valid(), false)
+		parents = []*testCert{first, second}
+		certs = append(certs, first.cert, second.cert)
+	}
+	leaf := issue(t, "leaf", parents[0], nil, valid(), false)
+	certs = append(certs, leaf.cert)
+
+	chain := SortedChain(certs, false)
+	if len(chain) != len(certs) {
+		t.Fatalf("got %v certificates, want %v", len(chain), len(certs))
+	}
+	if chain[0].Subject.CommonName != "leaf" || chain[levels+1].Subject.CommonName != "root" {
+		t.Fatalf("got chain %v", chainNames(chain))
+	}
+}
@@ -0,0 +1,279 @@
+package certutil
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many missing issuers are looked up for one chain, in case a bundle or AIA URL points back at itself
+const maxCompletionDepth = 10
+
+// Fetched issuers larger than this are rejected
+const maxIssuerSize = 1 << 20
+
+// The issuer of a certificate could not be found locally or fetched
+var ErrIssuerNotFound = errors.New("issuer not found")
+
+// Adds missing intermediates to a chain, from a local bundle directory and/or the leaf's AIA caIssuers URLs
+type ChainCompleter struct {
+	// Directory of PEM or DER files (*.pem, *.crt, *.cer) to search for issuers
+	BundleDir string
+	// Fetch issuers from the caIssuers URLs in the Authority Information Access extension
+	FetchAIA bool
+	// Directory where fetched issuers are cached. Caching is disabled if empty
+	CacheDir string
+	// Used for AIA requests. http.DefaultClient is used if nil
+	HTTPClient *http.Client
+
+	// BundleDir as last read, reread when its modification time changes (a file is added, removed or renamed)
+	mu            sync.Mutex
+	bundle        []*x509.Certificate
+	bundleModTime time.Time
+}
+
+// Returns the certs with any issuers needed to extend the chain towards a self-signed root. The
+// certs are returned unchanged, along with an error, if the chain could not be completed
+func (c *ChainCompleter) Complete(certs []*x509.Certificate) ([]*x509.Certificate, error) {
+	if c == nil || len(certs) == 0 || (c.BundleDir == "" && !c.FetchAIA) {
+		return certs, nil
+	}
+
+	var bundle []*x509.Certificate
+	if c.BundleDir != "" {
+		var err error
+		bundle, err = c.loadBundle()
+		if err != nil {
+			return certs, err
+		}
+	}
+
+	completed := certs
+	for i := 0; i < maxCompletionDepth; i++ {
+		chain, _ := chainPath(completed)
+		last := chain[len(chain)-1]
+		if isSelfSigned(last) {
+			return completed, nil
+		}
+
+		issuer, err := c.findIssuer(last, bundle)
+		if err != nil {
+			// Without the root in the bundle, stopping at an intermediate signed by a trusted root is normal
+			if len(chain) > 1 && errors.Is(err, ErrIssuerNotFound) {
+				return completed, nil
+			}
+			return certs, fmt.Errorf("completing chain for %v: %w", last.Subject, err)
+		}
+
+		completed = append(append([]*x509.Certificate{}, completed...), issuer)
+	}
+
+	return certs, fmt.Errorf("completing chain: more than %v issuers missing", maxCompletionDepth)
+}
+
+// Returns the certificates in BundleDir, only reading the directory again once it has changed
+func (c *ChainCompleter) loadBundle() ([]*x509.Certificate, error) {
+	info, err := os.Stat(c.BundleDir)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.bundle != nil && info.ModTime().Equal(c.bundleModTime) {
+		return c.bundle, nil
+	}
+
+	bundle, err := loadBundleDir(c.BundleDir)
+	if err != nil {
+		return nil, err
+	}
+	c.bundle = bundle
+	c.bundleModTime = info.ModTime()
+
+	return bundle, nil
+}
+
+func (c *ChainCompleter) findIssuer(cert *x509.Certificate, bundle []*x509.Certificate) (*x509.Certificate, error) {
+	for _, candidate := range bundle {
+		if isIssuedBy(cert, candidate) {
+			return candidate, nil
+		}
+	}
+
+	if !c.FetchAIA || len(cert.IssuingCertificateURL) == 0 {
+		return nil, ErrIssuerNotFound
+	}
+
+	var errs []string
+	for _, url := range cert.IssuingCertificateURL {
+		issuers, err := c.fetchIssuers(url)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		for _, issuer := range issuers {
+			if isIssuedBy(cert, issuer) {
+				return issuer, nil
+			}
+		}
+		errs = append(errs, fmt.Sprintf("%v did not issue the certificate", url))
+	}
+
+	return nil, fmt.Errorf("%w: %v", ErrIssuerNotFound, strings.Join(errs, "; "))
+}
+
+// Fetches the certificates published at a caIssuers URL, either a single certificate or a PKCS#7 bundle (.p7c),
+// using the on-disk cache while any of the cached certificates is still valid
+func (c *ChainCompleter) fetchIssuers(url string) ([]*x509.Certificate, error) {
+	cachePath := ""
+	if c.CacheDir != "" {
+		sum := sha256.Sum256([]byte(url))
+		cachePath = filepath.Join(c.CacheDir, hex.EncodeToString(sum[:])+".crt")
+
+		if data, err := ioutil.ReadFile(cachePath); err == nil {
+			if certs, err := parseCertsData(data); err == nil {
+				if unexpired := unexpiredCerts(certs, time.Now()); len(unexpired) > 0 {
+					return unexpired, nil
+				}
+			}
+		}
+	}
+
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("unsupported caIssuers URL %v", url)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %v: %v", url, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxIssuerSize))
+	if err != nil {
+		return nil, fmt.Errorf("fetching %v: %w", url, err)
+	}
+
+	certs, err := parseCertsData(data)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %v: %w", url, err)
+	}
+
+	if cachePath != "" {
+		if err := writeCache(c.CacheDir, cachePath, certs); err != nil {
+			return nil, err
+		}
+	}
+
+	return certs, nil
+}
+
+// Writes the certificates as PEM to a temporary file in dir then renames it into place, so a concurrent
+// reader never sees half a file and concurrent writers don't share a temporary file
+func writeCache(dir string, path string, certs []*x509.Certificate) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	for _, cert := range certs {
+		if err := pem.Encode(tmp, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func unexpiredCerts(certs []*x509.Certificate, now time.Time) []*x509.Certificate {
+	var results []*x509.Certificate
+	for _, cert := range certs {
+		if now.Before(cert.NotAfter) {
+			results = append(results, cert)
+		}
+	}
+	return results
+}
+
+// Reads every certificate from the *.pem, *.crt and *.cer files in dir
+func loadBundleDir(dir string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+
+	for _, pattern := range []string{"*.pem", "*.crt", "*.cer"} {
+		paths, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, path := range paths {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+
+			found, err := parseCertsData(data)
+			if err != nil {
+				return nil, fmt.Errorf("reading CA bundle %v: %w", path, err)
+			}
+			certs = append(certs, found...)
+		}
+	}
+
+	return certs, nil
+}
+
+// Parses all the certificates in PEM data, a single DER encoded certificate, or a PKCS#7 bundle in DER or PEM
+func parseCertsData(data []byte) ([]*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		cert, err := x509.ParseCertificate(data)
+		if err == nil {
+			return []*x509.Certificate{cert}, nil
+		}
+		if certs, pkcs7Err := parsePkcs7Certs(data); pkcs7Err == nil {
+			return certs, nil
+		}
+		return nil, fmt.Errorf("%w: not a certificate or PKCS#7 bundle: %v", ErrInvalidPem, err)
+	}
+
+	if block.Type == "PKCS7" {
+		return parsePkcs7Certs(block.Bytes)
+	}
+
+	return findCertsInPemBlocks(stringToPemBlocks(string(data)))
+}
@@ -0,0 +1,254 @@
+package certutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Issues a leaf signed by parent whose AIA extension points at the given caIssuers URLs
+func issueLeafWithAIA(t *testing.T, parent *testCert, urls ...string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial),
+		Subject:               pkix.Name{CommonName: "leaf"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              valid(),
+		IssuingCertificateURL: urls,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent.cert, key.Public(), parent.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+// A degenerate PKCS#7 SignedData holding just the certificates, as published in .p7c files
+func p7c(t *testing.T, certs ...*testCert) []byte {
+	t.Helper()
+
+	var raw []byte
+	for _, c := range certs {
+		raw = append(raw, c.cert.Raw...)
+	}
+
+	empty := asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true}
+	content, err := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+	}{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedData, err := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: empty,
+		ContentInfo:      asn1.RawValue{FullBytes: content},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw},
+		SignerInfos:      empty,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return der
+}
+
+// Serves the given bodies by path, counting requests. Unknown paths get a 500
+func issuerServer(t *testing.T, bodies map[string][]byte) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		body, ok := bodies[r.URL.Path]
+		if !ok {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func completedNames(t *testing.T, certs []*x509.Certificate) []string {
+	t.Helper()
+
+	var names []string
+	for _, cert := range SortedChain(certs, false) {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+func TestCompleteFetchesIssuerFromAIA(t *testing.T) {
+	root := issue(t, "root", nil, nil, valid(), false)
+	intermediate := issue(t, "intermediate", root, nil, valid(), false)
+	server, requests := issuerServer(t, map[string][]byte{"/intermediate.crt": intermediate.cert.Raw})
+	leaf := issueLeafWithAIA(t, intermediate, server.URL+"/intermediate.crt")
+
+	completer := &ChainCompleter{FetchAIA: true}
+	completed, err := completer.Complete([]*x509.Certificate{leaf})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The intermediate has no AIA, and stopping short of a root nobody provided is normal
+	if got := completedNames(t, completed); len(got) != 2 || got[1] != "intermediate" {
+		t.Fatalf("got chain %v, want leaf and intermediate", got)
+	}
+	if *requests != 1 {
+		t.Fatalf("got %v requests, want 1", *requests)
+	}
+}
+
+func TestCompleteUsesCachedIssuer(t *testing.T) {
+	root := issue(t, "root", nil, nil, valid(), false)
+	intermediate := issue(t, "intermediate", root, nil, valid(), false)
+	server, requests := issuerServer(t, map[string][]byte{"/intermediate.crt": intermediate.cert.Raw})
+	leaf := issueLeafWithAIA(t, intermediate, server.URL+"/intermediate.crt")
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+
+	for i := 0; i < 2; i++ {
+		completer := &ChainCompleter{FetchAIA: true, CacheDir: cacheDir}
+		completed, err := completer.Complete([]*x509.Certificate{leaf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(completed) != 2 {
+			t.Fatalf("got %v certificates, want 2", len(completed))
+		}
+	}
+
+	if *requests != 1 {
+		t.Fatalf("got %v requests, want the second completion to come from the cache", *requests)
+	}
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || filepath.Ext(entries[0].Name()) != ".crt" {
+		t.Fatalf("got cache entries %v, want a single .crt file", entries)
+	}
+}
+
+func TestCompleteFetchFailure(t *testing.T) {
+	root := issue(t, "root", nil, nil, valid(), false)
+	intermediate := issue(t, "intermediate", root, nil, valid(), false)
+	wrong := issue(t, "intermediate", root, nil, valid(), false)
+	server, _ := issuerServer(t, map[string][]byte{
+		"/wrong.crt":   wrong.cert.Raw,
+		"/garbage.crt": []byte("not a certificate"),
+	})
+
+	for _, path := range []string{"/missing.crt", "/wrong.crt", "/garbage.crt"} {
+		leaf := issueLeafWithAIA(t, intermediate, server.URL+path)
+
+		completer := &ChainCompleter{FetchAIA: true}
+		completed, err := completer.Complete([]*x509.Certificate{leaf})
+		if !errors.Is(err, ErrIssuerNotFound) {
+			t.Fatalf("%v: got error %v, want ErrIssuerNotFound", path, err)
+		}
+		if len(completed) != 1 || !completed[0].Equal(leaf) {
+			t.Fatalf("%v: got %v certificates, want the leaf back unchanged", path, len(completed))
+		}
+	}
+}
+
+func TestCompleteFetchesPkcs7Issuers(t *testing.T) {
+	root := issue(t, "root", nil, nil, valid(), false)
+	intermediate := issue(t, "intermediate", root, nil, valid(), false)
+	other := issue(t, "other", nil, nil, valid(), false)
+	bundle := p7c(t, other, intermediate)
+	server, _ := issuerServer(t, map[string][]byte{
+		"/issuers.p7c":     bundle,
+		"/issuers.p7c.pem": pem.EncodeToMemory(&pem.Block{Type: "PKCS7", Bytes: bundle}),
+	})
+
+	for _, path := range []string{"/issuers.p7c", "/issuers.p7c.pem"} {
+		leaf := issueLeafWithAIA(t, intermediate, server.URL+path)
+
+		completer := &ChainCompleter{FetchAIA: true, CacheDir: t.TempDir()}
+		completed, err := completer.Complete([]*x509.Certificate{leaf})
+		if err != nil {
+			t.Fatalf("%v: %v", path, err)
+		}
+		if got := completedNames(t, completed); len(got) != 2 || got[1] != "intermediate" {
+			t.Fatalf("%v: got chain %v, want leaf and intermediate", path, got)
+		}
+	}
+}
+
+func TestParsePkcs7RejectsOtherContent(t *testing.T) {
+	der, err := asn1.Marshal(pkcs7ContentInfo{ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := parsePkcs7Certs(der); !errors.Is(err, ErrInvalidPkcs7) {
+		t.Fatalf("got error %v, want ErrInvalidPkcs7", err)
+	}
+}
+
+func TestCompleteRereadsChangedBundleDir(t *testing.T) {
+	root := issue(t, "root", nil, nil, valid(), false)
+	intermediate := issue(t, "intermediate", root, nil, valid(), false)
+	leaf := issue(t, "leaf", intermediate, nil, valid(), false)
+	bundleDir := t.TempDir()
+	completer := &ChainCompleter{BundleDir: bundleDir}
+
+	if _, err := completer.Complete([]*x509.Certificate{leaf.cert}); !errors.Is(err, ErrIssuerNotFound) {
+		t.Fatalf("got error %v from an empty bundle, want ErrIssuerNotFound", err)
+	}
+
+	path := filepath.Join(bundleDir, "intermediates.pem")
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intermediate.cert.Raw}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.cert.Raw})...)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the directory looks changed even on filesystems with coarse timestamps
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(bundleDir, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	completed, err := completer.Complete([]*x509.Certificate{leaf.cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := completedNames(t, completed); len(got) != 3 || got[2] != "root" {
+		t.Fatalf("got chain %v, want leaf, intermediate and root", got)
+	}
+}
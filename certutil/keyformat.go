@@ -0,0 +1,308 @@
+package certutil
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/ssh"
+)
+
+// The encoding used when writing out a private key
+type KeyFormat string
+
+const (
+	// PRIVATE KEY, or ENCRYPTED PRIVATE KEY with a passphrase
+	Pkcs8KeyFormat KeyFormat = "pkcs8"
+	// RSA PRIVATE KEY
+	Pkcs1KeyFormat KeyFormat = "pkcs1"
+	// EC PRIVATE KEY
+	Sec1KeyFormat KeyFormat = "sec1"
+	// OPENSSH PRIVATE KEY
+	OpenSSHKeyFormat KeyFormat = "openssh"
+)
+
+// Iterations used to derive the key encrypting a PKCS#8 private key
+const pbkdf2Iterations = 100000
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	EncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	Prf            pkix.AlgorithmIdentifier
+}
+
+// The outer structure of an OPENSSH PRIVATE KEY block, after its magic string
+type openSSHPrivateKey struct {
+	CipherName   string
+	KdfName      string
+	KdfOpts      string
+	NumKeys      uint32
+	PubKey       []byte
+	PrivKeyBlock []byte
+}
+
+const openSSHMagic = "openssh-key-v1\x00"
+
+// Takes a PEM Encoded private key as String and re-encodes it in the given format. A passphrase is only
+// supported for PKCS#8, which is then encrypted with PBES2 (PBKDF2-SHA256 and AES-256-CBC) under a random
+// salt and IV. Other formats only depend on the key, so re-rendering an unchanged key gives the same result.
+func FormatPemPrivateKey(data string, format KeyFormat, passphrase string) (string, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return "", ErrNoPrivateKey
+	}
+	key, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+
+	if passphrase != "" && format != Pkcs8KeyFormat {
+		return "", fmt.Errorf("a passphrase is only supported for the %v key format, not %v", Pkcs8KeyFormat, format)
+	}
+
+	var out *pem.Block
+	switch format {
+	case Pkcs8KeyFormat:
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrUnsupportedKeyType, err)
+		}
+		out = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+		if passphrase != "" {
+			out, err = encryptPkcs8(der, passphrase)
+			if err != nil {
+				return "", err
+			}
+		}
+	case Pkcs1KeyFormat:
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return "", fmt.Errorf("%w: %T can't be written as %v", ErrUnsupportedKeyType, key, format)
+		}
+		out = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}
+	case Sec1KeyFormat:
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return "", fmt.Errorf("%w: %T can't be written as %v", ErrUnsupportedKeyType, key, format)
+		}
+		der, err := x509.MarshalECPrivateKey(ecKey)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrUnsupportedKeyType, err)
+		}
+		out = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case OpenSSHKeyFormat:
+		out, err = marshalOpenSSH(key)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unknown private key format %q, expected one of %v, %v, %v or %v",
+			format, Pkcs8KeyFormat, Pkcs1KeyFormat, Sec1KeyFormat, OpenSSHKeyFormat)
+	}
+
+	return string(pem.EncodeToMemory(out)), nil
+}
+
+// Encrypts PKCS#8 DER as an ENCRYPTED PRIVATE KEY block with a random salt and IV
+func encryptPkcs8(der []byte, passphrase string) (*pem.Block, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	key := pbkdf2.Key([]byte(passphrase), salt, pbkdf2Iterations, 32, sha256.New)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// PKCS#7 padding
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	encrypted := make([]byte, len(der)+padding)
+	copy(encrypted, der)
+	for i := len(der); i < len(encrypted); i++ {
+		encrypted[i] = byte(padding)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pbkdf2Iterations,
+		Prf:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParams}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		EncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData:       encrypted,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: info}, nil
+}
+
+// Decrypts an ENCRYPTED PRIVATE KEY block written by encryptPkcs8, returning the PKCS#8 DER. Other PBES2
+// parameters are rejected rather than supported
+func decryptPkcs8(der []byte, passphrase string) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPem, err)
+	}
+	if !info.EncryptionAlgorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("%w: unsupported encryption %v", ErrUnsupportedKeyType, info.EncryptionAlgorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.EncryptionAlgorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPem, err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) || !params.EncryptionScheme.Algorithm.Equal(oidAES256CBC) {
+		return nil, fmt.Errorf("%w: unsupported PBES2 parameters", ErrUnsupportedKeyType)
+	}
+
+	var kdfParams pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPem, err)
+	}
+	if !kdfParams.Prf.Algorithm.Equal(oidHMACWithSHA256) {
+		return nil, fmt.Errorf("%w: unsupported PBKDF2 PRF %v", ErrUnsupportedKeyType, kdfParams.Prf.Algorithm)
+	}
+	if kdfParams.IterationCount <= 0 || kdfParams.IterationCount > 10*pbkdf2Iterations {
+		return nil, fmt.Errorf("%w: unsupported PBKDF2 iteration count %v", ErrUnsupportedKeyType, kdfParams.IterationCount)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPem, err)
+	}
+	if len(iv) != aes.BlockSize || len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: bad IV or encrypted data length", ErrInvalidPem)
+	}
+
+	key := pbkdf2.Key([]byte(passphrase), kdfParams.Salt, kdfParams.IterationCount, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	decrypted := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, info.EncryptedData)
+
+	// A wrong passphrase almost always shows up as bad padding
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, ErrIncorrectPassword
+	}
+	for _, b := range decrypted[len(decrypted)-padding:] {
+		if int(b) != padding {
+			return nil, ErrIncorrectPassword
+		}
+	}
+
+	return decrypted[:len(decrypted)-padding], nil
+}
+
+// Looks in previous (e.g. the file a sink last wrote) for an ENCRYPTED PRIVATE KEY block that decrypts with
+// passphrase to the same key as the PEM Encoded private key in data. Writing that block again instead of
+// encrypting under a fresh salt and IV keeps an unchanged key from rewriting the sink every cycle
+func FindEncryptedPrivateKey(previous string, data string, passphrase string) (string, bool) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return "", false
+	}
+	key, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		return "", false
+	}
+	comparable, ok := key.(interface{ Equal(crypto.PrivateKey) bool })
+	if !ok {
+		return "", false
+	}
+
+	for _, candidate := range stringToPemBlocks(previous) {
+		if candidate.Type != "ENCRYPTED PRIVATE KEY" {
+			continue
+		}
+		der, err := decryptPkcs8(candidate.Bytes, passphrase)
+		if err != nil {
+			continue
+		}
+		previousKey, err := parsePrivateKey(der)
+		if err != nil {
+			continue
+		}
+		if comparable.Equal(previousKey) {
+			return string(pem.EncodeToMemory(candidate)), true
+		}
+	}
+
+	return "", false
+}
+
+// Writes an unencrypted OPENSSH PRIVATE KEY block. The ssh package fills the check integers with random
+// bytes, so they are replaced with ones derived from the public key to keep the output stable
+func marshalOpenSSH(key interface{}) (*pem.Block, error) {
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedKeyType, err)
+	}
+
+	var parsed openSSHPrivateKey
+	if err := ssh.Unmarshal(block.Bytes[len(openSSHMagic):], &parsed); err != nil {
+		return nil, err
+	}
+	if parsed.CipherName != "none" || len(parsed.PrivKeyBlock) < 8 {
+		return nil, fmt.Errorf("unexpected OpenSSH private key layout")
+	}
+
+	sum := sha256.Sum256(parsed.PubKey)
+	copy(parsed.PrivKeyBlock[0:4], sum[:4])
+	copy(parsed.PrivKeyBlock[4:8], sum[:4])
+
+	block.Bytes = append([]byte(openSSHMagic), ssh.Marshal(parsed)...)
+	return block, nil
+}
@@ -0,0 +1,184 @@
+package certutil
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A private key as PEM PKCS#8, the form privateKey returns
+func pemPkcs8(t *testing.T, key crypto.PrivateKey) string {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func testKeys(t *testing.T) map[string]crypto.PrivateKey {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]crypto.PrivateKey{"rsa": rsaKey, "ecdsa": ecKey, "ed25519": edKey}
+}
+
+func TestFormatPemPrivateKey(t *testing.T) {
+	keys := testKeys(t)
+
+	tests := []struct {
+		format    KeyFormat
+		blockType string
+		parse     func([]byte) (interface{}, error)
+		// Key types the format can't hold
+		unsupported map[string]bool
+	}{
+		{Pkcs8KeyFormat, "PRIVATE KEY", func(der []byte) (interface{}, error) { return x509.ParsePKCS8PrivateKey(der) }, nil},
+		{Pkcs1KeyFormat, "RSA PRIVATE KEY", func(der []byte) (interface{}, error) { return x509.ParsePKCS1PrivateKey(der) },
+			map[string]bool{"ecdsa": true, "ed25519": true}},
+		{Sec1KeyFormat, "EC PRIVATE KEY", func(der []byte) (interface{}, error) { return x509.ParseECPrivateKey(der) },
+			map[string]bool{"rsa": true, "ed25519": true}},
+		{OpenSSHKeyFormat, "OPENSSH PRIVATE KEY", nil, nil},
+	}
+
+	for _, test := range tests {
+		for name, key := range keys {
+			t.Run(string(test.format)+"/"+name, func(t *testing.T) {
+				out, err := FormatPemPrivateKey(pemPkcs8(t, key), test.format, "")
+				if test.unsupported[name] {
+					if !errors.Is(err, ErrUnsupportedKeyType) {
+						t.Fatalf("got error %v, want ErrUnsupportedKeyType", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				block, _ := pem.Decode([]byte(out))
+				if block == nil || block.Type != test.blockType {
+					t.Fatalf("got %q, want a %v block", out, test.blockType)
+				}
+
+				var parsed interface{}
+				if test.parse != nil {
+					parsed, err = test.parse(block.Bytes)
+				} else {
+					parsed, err = ssh.ParseRawPrivateKey([]byte(out))
+					// The ssh package returns ed25519 keys as a pointer
+					if edKey, ok := parsed.(*ed25519.PrivateKey); ok {
+						parsed = *edKey
+					}
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !key.(interface{ Equal(crypto.PrivateKey) bool }).Equal(parsed) {
+					t.Fatalf("round trip changed the key")
+				}
+
+				again, err := FormatPemPrivateKey(pemPkcs8(t, key), test.format, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if again != out {
+					t.Fatalf("unencrypted output changed between renders")
+				}
+			})
+		}
+	}
+}
+
+func TestFormatPemPrivateKeyRejectsPassphraseForOtherFormats(t *testing.T) {
+	for name, key := range testKeys(t) {
+		if _, err := FormatPemPrivateKey(pemPkcs8(t, key), OpenSSHKeyFormat, "secret"); err == nil {
+			t.Fatalf("%v: got no error for an encrypted openssh key", name)
+		}
+	}
+}
+
+func TestEncryptedPkcs8RoundTrip(t *testing.T) {
+	for name, key := range testKeys(t) {
+		t.Run(name, func(t *testing.T) {
+			out, err := FormatPemPrivateKey(pemPkcs8(t, key), Pkcs8KeyFormat, "correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			block, _ := pem.Decode([]byte(out))
+			if block == nil || block.Type != "ENCRYPTED PRIVATE KEY" {
+				t.Fatalf("got %q, want an ENCRYPTED PRIVATE KEY block", out)
+			}
+
+			der, err := decryptPkcs8(block.Bytes, "correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := x509.ParsePKCS8PrivateKey(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !key.(interface{ Equal(crypto.PrivateKey) bool }).Equal(parsed) {
+				t.Fatalf("decrypted key differs")
+			}
+
+			if _, err := decryptPkcs8(block.Bytes, "wrong horse"); err == nil {
+				t.Fatalf("decrypted with the wrong passphrase")
+			}
+
+			again, err := FormatPemPrivateKey(pemPkcs8(t, key), Pkcs8KeyFormat, "correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again == out {
+				t.Fatalf("two encryptions used the same salt and IV")
+			}
+		})
+	}
+}
+
+func TestFindEncryptedPrivateKey(t *testing.T) {
+	keys := testKeys(t)
+	key := pemPkcs8(t, keys["ecdsa"])
+	encrypted, err := FormatPemPrivateKey(key, Pkcs8KeyFormat, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := "# written by the agent\n" + pemPkcs8(t, keys["rsa"]) + encrypted
+
+	found, ok := FindEncryptedPrivateKey(previous, key, "passphrase")
+	if !ok || found != encrypted {
+		t.Fatalf("did not find the previously encrypted key")
+	}
+
+	if _, ok := FindEncryptedPrivateKey(previous, key, "other passphrase"); ok {
+		t.Fatalf("reused a key encrypted with a different passphrase")
+	}
+	if _, ok := FindEncryptedPrivateKey(previous, pemPkcs8(t, keys["ed25519"]), "passphrase"); ok {
+		t.Fatalf("reused a different key")
+	}
+	if _, ok := FindEncryptedPrivateKey("", key, "passphrase"); ok {
+		t.Fatalf("found a key in an empty file")
+	}
+}
@@ -0,0 +1,56 @@
+package certutil
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+// The data was PKCS#7 that holds no certificates, or could not be read
+var ErrInvalidPkcs7 = errors.New("invalid PKCS#7 data")
+
+var oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      asn1.RawValue
+}
+
+// Reads the certificates from a DER encoded PKCS#7 SignedData, which is how caIssuers URLs often publish
+// issuers (.p7c). Only DER is supported, as that is what RFC 5280 asks for; BER encodings are rejected
+func parsePkcs7Certs(der []byte) ([]*x509.Certificate, error) {
+	var contentInfo pkcs7ContentInfo
+	if rest, err := asn1.Unmarshal(der, &contentInfo); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPkcs7, err)
+	} else if len(rest) > 0 {
+		return nil, fmt.Errorf("%w: trailing data", ErrInvalidPkcs7)
+	}
+	if !contentInfo.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("%w: content type %v is not signed data", ErrInvalidPkcs7, contentInfo.ContentType)
+	}
+
+	var signedData pkcs7SignedData
+	if _, err := asn1.Unmarshal(contentInfo.Content.Bytes, &signedData); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPkcs7, err)
+	}
+	if len(signedData.Certificates.Bytes) == 0 {
+		return nil, fmt.Errorf("%w: no certificates", ErrInvalidPkcs7)
+	}
+
+	certs, err := x509.ParseCertificates(signedData.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPkcs7, err)
+	}
+
+	return certs, nil
+}
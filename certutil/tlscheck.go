@@ -0,0 +1,183 @@
+package certutil
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// The private key does not belong to the leaf certificate
+	ErrKeyMismatch = errors.New("private key does not match certificate")
+	// The leaf certificate has expired
+	ErrCertExpired = errors.New("certificate has expired")
+	// The leaf certificate is not valid yet
+	ErrCertNotYetValid = errors.New("certificate is not yet valid")
+	// The chain does not verify to the trust store
+	ErrUntrustedChain = errors.New("certificate chain does not verify")
+)
+
+// How a certificate and key are checked by VerifyPemKeyPair
+type KeyPairOptions struct {
+	// Certificates the chain must verify to. The system roots are used if nil
+	Roots *x509.CertPool
+	// Only check the key and validity period
+	SkipChain bool
+	// The time to check validity at. time.Now() is used if zero
+	Now time.Time
+}
+
+// Takes PEM Encoded certificates (leaf and any issuers) and a PEM Encoded private key as Strings and checks that the
+// key belongs to the leaf, that the leaf is within its validity period and that the chain verifies
+func VerifyPemKeyPair(certData string, keyData string, opts KeyPairOptions) error {
+	certs, err := findCertsInPemBlocks(stringToPemBlocks(certData))
+	if err != nil {
+		return err
+	}
+	chain := SortedChain(certs, false)
+	leaf := chain[0]
+
+	key, err := findSignerInPemBlocks(stringToPemBlocks(keyData))
+	if err != nil {
+		return err
+	}
+
+	public, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !public.Equal(leaf.PublicKey) {
+		return fmt.Errorf("%w %v", ErrKeyMismatch, leaf.Subject)
+	}
+
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("%w: %v is valid from %v", ErrCertNotYetValid, leaf.Subject, leaf.NotBefore)
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("%w: %v expired at %v", ErrCertExpired, leaf.Subject, leaf.NotAfter)
+	}
+
+	if opts.SkipChain {
+		return nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for i := range chain[1:] {
+		intermediates.AddCert(&chain[i+1])
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         opts.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUntrustedChain, err)
+	}
+
+	return nil
+}
+
+// Reads the certificates in a PEM or DER file, or in the *.pem, *.crt and *.cer files of a directory
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	if info.IsDir() {
+		certs, err = loadBundleDir(path)
+	} else {
+		var data []byte
+		data, err = ioutil.ReadFile(path)
+		if err == nil {
+			certs, err = parseCertsData(data)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading trust store %v: %w", path, err)
+	}
+
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
+
+// Whether the PEM data holds a certificate for VerifyPemKeyPair
+func HasPemCertificate(data string) bool {
+	for _, block := range stringToPemBlocks(data) {
+		if block.Type == "CERTIFICATE" {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the PEM data holds a private key VerifyPemKeyPair can check, which an encrypted one is not
+func HasCheckablePrivateKey(data string) bool {
+	for _, block := range stringToPemBlocks(data) {
+		if isPrivateKeyBlock(block) && !isEncryptedKeyBlock(block) {
+			return true
+		}
+	}
+	return false
+}
+
+func isPrivateKeyBlock(block *pem.Block) bool {
+	return block.Type == "PRIVATE KEY" || strings.HasSuffix(block.Type, " PRIVATE KEY")
+}
+
+// PKCS#8 encrypted keys, and legacy PEM encryption marked by a Proc-Type header
+func isEncryptedKeyBlock(block *pem.Block) bool {
+	return block.Type == "ENCRYPTED PRIVATE KEY" || strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED")
+}
+
+// Attempts to find a private key usable for signing in array of pem.Block, in any format privateKeyAs writes.
+// Encrypted keys are passed over, and only reported if there is no other key
+func findSignerInPemBlocks(blocks []*pem.Block) (crypto.Signer, error) {
+	encrypted := false
+	for _, block := range blocks {
+		var key interface{}
+		var err error
+		switch {
+		case isPrivateKeyBlock(block) && isEncryptedKeyBlock(block):
+			encrypted = true
+			continue
+		case block.Type == "OPENSSH PRIVATE KEY":
+			key, err = ssh.ParseRawPrivateKey(pem.EncodeToMemory(block))
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidPem, err)
+			}
+		case isPrivateKeyBlock(block):
+			key, err = parsePrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			continue
+		}
+
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%w: %T", ErrUnsupportedKeyType, key)
+		}
+		return signer, nil
+	}
+
+	if encrypted {
+		return nil, fmt.Errorf("%w: can't check an encrypted private key", ErrUnsupportedKeyType)
+	}
+	return nil, ErrNoPrivateKey
+}
@@ -0,0 +1,65 @@
+package certutil
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Takes PEM Encoded data as String and returns every certificate in it
+func CertsFromPem(data string) ([]*x509.Certificate, error) {
+	return findCertsInPemBlocks(stringToPemBlocks(data))
+}
+
+// Takes Base64 Encoded PKCS12 as String and returns every certificate in it
+func CertsFromPkcs12(b64pkcs12 string, password string) ([]*x509.Certificate, error) {
+	blocks, err := pkcs12ToPemBlocks(b64pkcs12, password)
+	if err != nil {
+		return nil, err
+	}
+	return findCertsInPemBlocks(blocks)
+}
+
+// Produces a PEM Encoded bundle of the certificates, deduplicated by SHA-256 fingerprint and sorted by subject so the
+// output doesn't depend on the order they were collected in. With dropExpired, certificates expired at now are left out
+func PemTrustBundle(certs []*x509.Certificate, dropExpired bool, now time.Time) (string, error) {
+	type entry struct {
+		subject     string
+		fingerprint [sha256.Size]byte
+		cert        *x509.Certificate
+	}
+
+	seen := make(map[[sha256.Size]byte]bool)
+	var entries []entry
+	for _, cert := range certs {
+		if dropExpired && now.After(cert.NotAfter) {
+			continue
+		}
+		fingerprint := sha256.Sum256(cert.Raw)
+		if seen[fingerprint] {
+			continue
+		}
+		seen[fingerprint] = true
+		entries = append(entries, entry{cert.Subject.String(), fingerprint, cert})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].subject != entries[j].subject {
+			return entries[i].subject < entries[j].subject
+		}
+		return bytes.Compare(entries[i].fingerprint[:], entries[j].fingerprint[:]) < 0
+	})
+
+	var bundle bytes.Buffer
+	for _, e := range entries {
+		if err := pem.Encode(&bundle, &pem.Block{Type: "CERTIFICATE", Bytes: e.cert.Raw}); err != nil {
+			return "", fmt.Errorf("failed to write data: %w", err)
+		}
+	}
+
+	return bundle.String(), nil
+}
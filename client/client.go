@@ -1,18 +1,23 @@
 package client
 
 import (
+	"context"
+
 	"github.com/covermymeds/azure-key-vault-agent/certs"
+	"github.com/covermymeds/azure-key-vault-agent/config"
 	"github.com/covermymeds/azure-key-vault-agent/keys"
 	"github.com/covermymeds/azure-key-vault-agent/secrets"
 )
 
+// Fetches resources from a vault. Every call gives up with the context's error once ctx is done
 type Client interface {
-	GetCert(vault string, certName string, certVersion string) (certs.Cert, error)
-	GetCerts(vault string) (results []certs.Cert, err error)
-	GetSecret(vault string, secretName string, secretVersion string) (secrets.Secret, error)
-	GetSecrets(vault string) (results map[string]secrets.Secret, err error)
-	GetKey(vault string, keyName string, keyVersion string) (keys.Key, error)
-	GetKeys(vault string) (results []keys.Key, err error)
+	GetCert(ctx context.Context, vault string, certName string, certVersion string) (certs.Cert, error)
+	GetCerts(ctx context.Context, vault string) (results map[string]certs.Cert, err error)
+	GetSecret(ctx context.Context, vault string, secretName string, secretVersion string) (secrets.Secret, error)
+	GetSecrets(ctx context.Context, vault string, filter config.SecretFilterConfig) (results map[string]secrets.Secret, err error)
+	GetSecretVersions(ctx context.Context, vault string, secretName string) (results []secrets.Secret, err error)
+	GetKey(ctx context.Context, vault string, keyName string, keyVersion string) (keys.Key, error)
+	GetKeys(ctx context.Context, vault string) (results map[string]keys.Key, err error)
 }
 
 type Clients map[string]Client
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
@@ -20,7 +21,7 @@ type CyberarkClient struct {
 	Safe string
 }
 
-func NewCyberarkClient(cred config.CyberarkCredentialConfig) CyberarkClient {
+func NewCyberarkClient(cred config.CyberarkCredentialConfig, options RequestOptions) CyberarkClient {
 	cyberarkConfig := conjurapi.Config{
 		Account: cred.Account,
 		ApplianceURL: cred.ApplianceURL,
@@ -35,57 +36,97 @@ func NewCyberarkClient(cred config.CyberarkCredentialConfig) CyberarkClient {
 	if err != nil {
 		panic(fmt.Sprintf("Error creating Cyberark client: %v", err.Error()))
 	}
+
+	httpClient := *cyberarkClient.GetHttpClient()
+	httpClient.Transport = newRetryTransport(httpClient.Transport, options)
+	cyberarkClient.SetHttpClient(&httpClient)
+
 	return CyberarkClient{Client: cyberarkClient}
 }
 
-func (c CyberarkClient) GetCert(safeName string, certName string, certVersion string) (certs.Cert, error) {
+func (c CyberarkClient) GetCert(ctx context.Context, safeName string, certName string, certVersion string) (certs.Cert, error) {
 	panic("cyberark doesn't have Cert type resources. use regular Secrets instead")
 }
 
-func (c CyberarkClient) GetCerts(safeName string) (results []certs.Cert, err error) {
+func (c CyberarkClient) GetCerts(ctx context.Context, safeName string) (results map[string]certs.Cert, err error) {
 	panic("cyberark doesn't have Cert type resources. use regular Secrets instead")
 }
 
-func (c CyberarkClient) GetSecret(safeName string, secretName string, secretVersion string) (secrets.Secret, error) {
+func (c CyberarkClient) GetSecret(ctx context.Context, safeName string, secretName string, secretVersion string) (secrets.Secret, error) {
 	var secretValue []byte
 	var err error
 
 	secretPath := fmt.Sprintf("data/vault/%s/%s", safeName, secretName)
 
 	if secretVersion == "" {
-		secretValue, err = c.Client.RetrieveSecret(secretPath)
+		err = withContext(ctx, func() (err error) {
+			secretValue, err = c.Client.RetrieveSecret(secretPath)
+			return err
+		})
 	} else {
 		secretVersionInt, convErr := strconv.Atoi(secretVersion)
 		if convErr != nil {
 			return secrets.Secret{}, fmt.Errorf("failed to convert secret version to integer: %s", secretVersion)
 		}
-		secretValue, err = c.Client.RetrieveSecretWithVersion(secretPath, secretVersionInt)
+		err = withContext(ctx, func() (err error) {
+			secretValue, err = c.Client.RetrieveSecretWithVersion(secretPath, secretVersionInt)
+			return err
+		})
 	}
 	if err != nil {
 		log.Printf("Error getting secret: %v", err.Error())
-		return secrets.Secret{}, err
+		return secrets.Secret{}, classifyError(err)
 	}
 
 	secretValueString := string(secretValue)
 	result := secrets.Secret{
+		Name: secretName,
 		Value: &secretValueString,
 		ContentType: nil,
+		Version: secretVersion,
+	}
+
+	if secretVersion == "" {
+		// The latest version number is only available from the variable's metadata
+		resource, err := c.resource(ctx, secretPath)
+		if err != nil {
+			log.Printf("Error getting version of secret %v: %v", secretName, err.Error())
+		} else {
+			result.Version = conjurLatestVersion(resource)
+		}
 	}
 
 	return result, nil
 }
 
-func (c CyberarkClient) GetSecrets(safeName string) (results map[string]secrets.Secret, err error) {
-	resources, err := c.Client.ResourceIDs(&conjurapi.ResourceFilter{Kind: "variable"})
+// Only keyPrefix is supported for Cyberark resources, which is applied by the worker, so filter is unused
+func (c CyberarkClient) GetSecrets(ctx context.Context, safeName string, filter config.SecretFilterConfig) (results map[string]secrets.Secret, err error) {
+	var variables []map[string]interface{}
+	err = withContext(ctx, func() (err error) {
+		variables, err = c.Client.Resources(&conjurapi.ResourceFilter{Kind: "variable"})
+		return err
+	})
 	if err != nil {
 		log.Printf("Error getting secrets: %v", err.Error())
-		return map[string]secrets.Secret{}, err
+		return map[string]secrets.Secret{}, classifyError(err)
 	}
 
-	secretValues, err := c.Client.RetrieveBatchSecrets(resources)
+	var resources []string
+	versions := make(map[string]string)
+	for _, variable := range variables {
+		resourceID := variable["id"].(string)
+		resources = append(resources, resourceID)
+		versions[resourceID] = conjurLatestVersion(variable)
+	}
+
+	var secretValues map[string][]byte
+	err = withContext(ctx, func() (err error) {
+		secretValues, err = c.Client.RetrieveBatchSecrets(resources)
+		return err
+	})
 	if err != nil {
 		log.Printf("Error getting secrets: %v", err.Error())
-		return map[string]secrets.Secret{}, err
+		return map[string]secrets.Secret{}, classifyError(err)
 	}
 
 	results = make(map[string]secrets.Secret)
@@ -94,8 +135,10 @@ func (c CyberarkClient) GetSecrets(safeName string) (results map[string]secrets.
 		modResourceID := strings.Replace(resourceID, fmt.Sprintf("conjur:variable:data/vault/%s/", safeName), "", 1)
 		secretValueString := string(value)
 		result := secrets.Secret{
+			Name: modResourceID,
 			Value: &secretValueString,
 			ContentType: nil,
+			Version: versions[resourceID],
 		}
 
 		results[modResourceID] = result
@@ -104,10 +147,58 @@ func (c CyberarkClient) GetSecrets(safeName string) (results map[string]secrets.
 	return results, nil
 }
 
-func (c CyberarkClient) GetKey(safeName string, keyName string, keyVersion string) (keys.Key, error) {
+// Lists the versions of a secret, newest first. Only the version is known, so Value is nil
+func (c CyberarkClient) GetSecretVersions(ctx context.Context, safeName string, secretName string) (results []secrets.Secret, err error) {
+	secretPath := fmt.Sprintf("data/vault/%s/%s", safeName, secretName)
+	resource, err := c.resource(ctx, secretPath)
+	if err != nil {
+		log.Printf("Error getting secret versions: %v", err.Error())
+		return nil, classifyError(err)
+	}
+
+	for _, version := range conjurVersions(resource) {
+		results = append(results, secrets.Secret{
+			Name:    secretName,
+			Version: strconv.Itoa(version),
+		})
+	}
+
+	return results, nil
+}
+
+// Fetches the metadata of the variable at secretPath
+func (c CyberarkClient) resource(ctx context.Context, secretPath string) (resource map[string]interface{}, err error) {
+	err = withContext(ctx, func() (err error) {
+		resource, err = c.Client.Resource(fmt.Sprintf("%s:variable:%s", c.Client.GetConfig().Account, secretPath))
+		return err
+	})
+	return resource, err
+}
+
+// Runs call, returning ctx's error as soon as ctx is done. The conjur client takes no context, so an
+// abandoned call carries on in the background until its request timeout
+func withContext(ctx context.Context, call func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c CyberarkClient) GetKey(ctx context.Context, safeName string, keyName string, keyVersion string) (keys.Key, error) {
 	panic("cyberark does not have a Key secret type. use regular Secrets instead")
 }
 
-func (c CyberarkClient) GetKeys(safeName string) ([]keys.Key, error) {
+func (c CyberarkClient) GetKeys(ctx context.Context, safeName string) (map[string]keys.Key, error) {
 	panic("cyberark does not have a Key secret type. use regular Secrets instead")
 }
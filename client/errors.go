@@ -0,0 +1,115 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/cyberark/conjur-api-go/conjurapi/response"
+)
+
+// The classes client errors fall into, for use with errors.Is
+var (
+	// The resource or vault doesn't exist
+	ErrNotFound = errors.New("not found")
+	// The credential isn't valid or isn't allowed to read the resource
+	ErrForbidden = errors.New("forbidden")
+	// The vault asked us to slow down
+	ErrThrottled = errors.New("throttled")
+	// A network failure or server error that may succeed if tried again
+	ErrTransient = errors.New("transient error")
+)
+
+// An error along with its class. Both match errors.Is
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e classifiedError) Error() string {
+	return e.class.Error() + ": " + e.err.Error()
+}
+
+func (e classifiedError) Unwrap() []error {
+	return []error{e.class, e.err}
+}
+
+// Attaches the error's class, if it has one, so callers can tell a missing secret from a throttled vault
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified classifiedError
+	if errors.As(err, &classified) {
+		return err
+	}
+	if class := errorClass(err); class != nil {
+		return classifiedError{class: class, err: err}
+	}
+	return err
+}
+
+func errorClass(err error) error {
+	// autorest.DetailedError has no Unwrap, so its status and original error are checked by hand
+	var detailed autorest.DetailedError
+	if errors.As(err, &detailed) {
+		if status, ok := detailed.StatusCode.(int); ok && status != 0 {
+			return statusClass(status)
+		}
+		// adal reports a token endpoint it couldn't reach without its cause or a response
+		if detailed.PackageType == "azure.BearerAuthorizer" {
+			return ErrTransient
+		}
+		if detailed.Original != nil {
+			return errorClass(detailed.Original)
+		}
+		return nil
+	}
+
+	var conjurErr *response.ConjurError
+	if errors.As(err, &conjurErr) {
+		return statusClass(conjurErr.Code)
+	}
+
+	for _, class := range []error{ErrNotFound, ErrForbidden, ErrThrottled, ErrTransient} {
+		if errors.Is(err, class) {
+			return class
+		}
+	}
+
+	// Cancellation belongs to the caller, not the vault
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrTransient
+	}
+
+	return nil
+}
+
+// The class of a response, or of the error returned instead of one
+func responseClass(resp *http.Response, err error) error {
+	if err != nil {
+		return errorClass(err)
+	}
+	return statusClass(resp.StatusCode)
+}
+
+func statusClass(status int) error {
+	switch {
+	case status == http.StatusNotFound:
+		return ErrNotFound
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrForbidden
+	case status == http.StatusTooManyRequests:
+		return ErrThrottled
+	case status == http.StatusRequestTimeout || status >= 500:
+		return ErrTransient
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/covermymeds/azure-key-vault-agent/config"
+)
+
+// An all-secrets filter with its patterns compiled, so they are compiled once per listing rather than per secret
+type secretFilter struct {
+	config.SecretFilterConfig
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// The patterns were validated when the config was parsed
+func newSecretFilter(filter config.SecretFilterConfig) secretFilter {
+	compiled := secretFilter{SecretFilterConfig: filter}
+	for _, pattern := range filter.Include {
+		compiled.include = append(compiled.include, regexp.MustCompile(pattern))
+	}
+	for _, pattern := range filter.Exclude {
+		compiled.exclude = append(compiled.exclude, regexp.MustCompile(pattern))
+	}
+	return compiled
+}
+
+// Reports whether a listed secret passes the filter
+func (f secretFilter) matches(name string, tags map[string]*string) bool {
+	if !strings.HasPrefix(name, f.Prefix) {
+		return false
+	}
+
+	if len(f.include) > 0 {
+		included := false
+		for _, pattern := range f.include {
+			if pattern.MatchString(name) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+
+	for _, pattern := range f.exclude {
+		if pattern.MatchString(name) {
+			return false
+		}
+	}
+
+	for key, want := range f.Tags {
+		value, ok := tags[key]
+		if !ok || value == nil || *value != want {
+			return false
+		}
+	}
+
+	return true
+}
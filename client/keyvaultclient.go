@@ -2,10 +2,15 @@ package client
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"net/http"
 	"net/url"
+	"path"
 	"regexp"
+	"sort"
+	"strings"
 	"github.com/covermymeds/azure-key-vault-agent/certs"
 	"github.com/covermymeds/azure-key-vault-agent/secrets"
 	"github.com/covermymeds/azure-key-vault-agent/keys"
@@ -17,33 +22,42 @@ import (
 
 type KeyvaultClient struct {
 	Client keyvault.BaseClient
+	cache  *secretCache
 }
 
-func NewKeyvaultClient(cred config.KeyvaultCredentialConfig) KeyvaultClient {
+func NewKeyvaultClient(cred config.KeyvaultCredentialConfig, options RequestOptions) KeyvaultClient {
 	c := keyvault.New()
+	// Retries are left to the transport. autorest's own would retry 429s indefinitely, outside the rate limiter
+	c.RetryAttempts = 0
+	c.RetryDuration = 0
+	if sender, ok := c.Sender.(*http.Client); ok {
+		httpClient := *sender
+		httpClient.Transport = newRetryTransport(sender.Transport, options)
+		c.Sender = &httpClient
+	}
 	authorizer, err := iam.GetKeyvaultAuthorizer(cred.TenantID, cred.ClientID, cred.ClientSecret)
 	if err != nil {
 		panic(fmt.Sprintf("Error authorizing: %v", err.Error()))
 	}
 	c.Authorizer = authorizer
-	return KeyvaultClient{c}
+	return KeyvaultClient{Client: c, cache: newSecretCache()}
 }
 
-func (c KeyvaultClient) GetCert(vaultBaseURL string, certName string, certVersion string) (certs.Cert, error) {
-	cert, err := c.Client.GetCertificate(context.Background(), vaultBaseURL, certName, certVersion)
+func (c KeyvaultClient) GetCert(ctx context.Context, vaultBaseURL string, certName string, certVersion string) (certs.Cert, error) {
+	cert, err := c.Client.GetCertificate(ctx, vaultBaseURL, certName, certVersion)
 	if err != nil {
 		log.Printf("Error getting cert: %v", err.Error())
-		return certs.Cert{}, err
+		return certs.Cert{}, classifyError(err)
 	}
 
 	return certs.Cert(cert), nil
 }
 
-func (c KeyvaultClient) getCertByURL(certURL string) (certs.Cert, error) {
+func (c KeyvaultClient) getCertByURL(ctx context.Context, certURL string) (string, certs.Cert, error) {
 	u, err := url.Parse(certURL)
 	if err != nil {
 		log.Printf("Failed to parse URL for cert: %v", err.Error())
-		return certs.Cert{}, err
+		return "invalid", certs.Cert{}, err
 	}
 	vaultBaseURL := fmt.Sprintf("%v://%v", u.Scheme, u.Host)
 
@@ -51,61 +65,66 @@ func (c KeyvaultClient) getCertByURL(certURL string) (certs.Cert, error) {
 	res := regex.FindAllStringSubmatch(u.Path, -1)
 	certName := res[0][1]
 
-	result, err := c.GetCert(vaultBaseURL, certName, "")
+	result, err := c.GetCert(ctx, vaultBaseURL, certName, "")
 	if err != nil {
 		log.Printf("Failed to get cert from parsed values %v and %v: %v", vaultBaseURL, certName, err.Error())
-		return certs.Cert{}, err
+		return "invalid", certs.Cert{}, err
 	}
 
-	return result, nil
+	return certName, result, nil
 }
 
-func (c KeyvaultClient) GetCerts(vaultBaseURL string) (results []certs.Cert, err error) {
+func (c KeyvaultClient) GetCerts(ctx context.Context, vaultBaseURL string) (results map[string]certs.Cert, err error) {
 	max := int32(25)
-	pages, err := c.Client.GetCertificates(context.Background(), vaultBaseURL, &max)
+	pages, err := c.Client.GetCertificates(ctx, vaultBaseURL, &max)
+	results = make(map[string]certs.Cert)
 	if err != nil {
 		log.Printf("Error getting cert: %v", err.Error())
-		return nil, err
+		return map[string]certs.Cert{}, classifyError(err)
 	}
 
 	for {
 		for _, value := range pages.Values() {
-			certURL := *value.ID
-			cert, err := c.getCertByURL(certURL)
-			if err != nil {
-				log.Printf("Error loading cert contents: %v", err.Error())
-				return nil, err
-			}
+			if value.Attributes == nil || value.Attributes.Enabled == nil || *value.Attributes.Enabled {
+				certURL := *value.ID
+				certName, cert, err := c.getCertByURL(ctx, certURL)
+				if err != nil {
+					log.Printf("Error loading cert contents: %v", err.Error())
+					return nil, err
+				}
 
-			results = append(results, cert)
+				results[certName] = cert
+			}
 		}
 
-		if pages.NotDone() {
-			pages.Next()
-		} else {
+		if !pages.NotDone() {
 			break
 		}
+		if err := pages.NextWithContext(ctx); err != nil {
+			return nil, classifyError(err)
+		}
 	}
 
 	return results, nil
 }
 
-func (c KeyvaultClient) GetSecret(vaultBaseURL string, secretName string, secretVersion string) (secrets.Secret, error) {
-	secret, err := c.Client.GetSecret(context.Background(), vaultBaseURL, secretName, secretVersion)
+func (c KeyvaultClient) GetSecret(ctx context.Context, vaultBaseURL string, secretName string, secretVersion string) (secrets.Secret, error) {
+	secret, err := c.Client.GetSecret(ctx, vaultBaseURL, secretName, secretVersion)
 	if err != nil {
 		log.Printf("Error getting secret: %v", err.Error())
-		return secrets.Secret{}, err
+		return secrets.Secret{}, classifyError(err)
 	}
 
 	result := secrets.Secret{
+		Name: secretName,
 		Value: secret.Value,
 		ContentType: secret.ContentType,
 	}
 
-	return result, nil
+	return withSecretMetadata(result, secret), nil
 }
 
-func (c KeyvaultClient) getSecretByURL(secretURL string) (string, secrets.Secret, error) {
+func (c KeyvaultClient) getSecretByURL(ctx context.Context, secretURL string) (string, secrets.Secret, error) {
 	u, err := url.Parse(secretURL)
 	if err != nil {
 		log.Printf("Failed to parse URL for secret: %v", err.Error())
@@ -113,11 +132,9 @@ func (c KeyvaultClient) getSecretByURL(secretURL string) (string, secrets.Secret
 	}
 	vaultBaseURL := fmt.Sprintf("%v://%v", u.Scheme, u.Host)
 
-	regex := *regexp.MustCompile(`/secrets/(.*)(/.*)?`)
-	res := regex.FindAllStringSubmatch(u.Path, -1)
-	secretName := res[0][1]
+	secretName := secretNameFromURL(secretURL)
 
-	result, err := c.GetSecret(vaultBaseURL, secretName, "")
+	result, err := c.GetSecret(ctx, vaultBaseURL, secretName, "")
 	if err != nil {
 		log.Printf("Failed to get secret from parsed values %v and %v: %v", vaultBaseURL, secretName, err.Error())
 		return "invalid", secrets.Secret{}, err
@@ -126,46 +143,123 @@ func (c KeyvaultClient) getSecretByURL(secretURL string) (string, secrets.Secret
 	return secretName, result, nil
 }
 
-func (c KeyvaultClient) GetSecrets(vaultBaseURL string) (results map[string]secrets.Secret, err error) {
+// Extracts the secret name from its identifier like https://vault/secrets/<name>
+func secretNameFromURL(secretURL string) string {
+	u, err := url.Parse(secretURL)
+	if err != nil {
+		return ""
+	}
+
+	regex := *regexp.MustCompile(`/secrets/(.*)(/.*)?`)
+	res := regex.FindAllStringSubmatch(u.Path, -1)
+	if len(res) == 0 {
+		return ""
+	}
+	return res[0][1]
+}
+
+// Fetches every enabled secret in the vault that passes filter. Only the list response is used to filter, so
+// secrets that don't match are never read. Secrets whose listing is unchanged since the last call are served from
+// the cache rather than read again, and secrets missing from the listing are dropped from it
+func (c KeyvaultClient) GetSecrets(ctx context.Context, vaultBaseURL string, filter config.SecretFilterConfig) (results map[string]secrets.Secret, err error) {
 	max := int32(25)
-	pages, err := c.Client.GetSecrets(context.Background(), vaultBaseURL, &max)
+	pages, err := c.Client.GetSecrets(ctx, vaultBaseURL, &max)
 	results = make(map[string]secrets.Secret)
 	if err != nil {
 		log.Printf("Error getting secret: %v", err.Error())
-		return map[string]secrets.Secret{}, err
+		return map[string]secrets.Secret{}, classifyError(err)
 	}
 
+	matcher := newSecretFilter(filter)
+	scope := secretCacheScope(vaultBaseURL, filter)
+	listed := make(map[string]cachedSecret)
+	hits, misses := 0, 0
 	for {
 		for _, value := range pages.Values() {
-			if *value.Attributes.Enabled {
+			if *value.Attributes.Enabled && matcher.matches(secretNameFromURL(*value.ID), value.Tags) {
 				secretURL := *value.ID
-				secretName, secret, err := c.getSecretByURL(secretURL)
+				updated := unixTime(value.Attributes.Updated)
+
+				if secret, ok := c.cache.get(scope, secretURL, updated); ok {
+					hits++
+					listed[secretURL] = cachedSecret{updated: *updated, secret: secret}
+					results[secret.Name] = secret
+					continue
+				}
+				misses++
+
+				secretName, secret, err := c.getSecretByURL(ctx, secretURL)
 
 				if err != nil {
 					log.Printf("Error loading secret contents: %v", err.Error())
 					return nil, err
 				}
 
+				if updated != nil {
+					listed[secretURL] = cachedSecret{updated: *updated, secret: secret}
+				}
 				results[secretName] = secret
 			}
 
 		}
 
-		if pages.NotDone() {
-			pages.Next()
-		} else {
+		if !pages.NotDone() {
 			break
 		}
+		if err := pages.NextWithContext(ctx); err != nil {
+			return nil, classifyError(err)
+		}
 	}
 
+	c.cache.replace(scope, listed)
+
+	log.WithFields(log.Fields{"vault": vaultBaseURL, "hits": hits, "misses": misses}).Printf("Listed %v secrets, read %v", hits+misses, misses)
+
 	return results, nil
 }
 
-func (c KeyvaultClient) GetKey(vaultBaseURL string, keyName string, keyVersion string) (keys.Key, error) {
-	key, err := c.Client.GetKey(context.Background(), vaultBaseURL, keyName, keyVersion)
+// Lists the versions of a secret, newest first. Only the metadata is listed, so Value is nil
+func (c KeyvaultClient) GetSecretVersions(ctx context.Context, vaultBaseURL string, secretName string) (results []secrets.Secret, err error) {
+	max := int32(25)
+	pages, err := c.Client.GetSecretVersions(ctx, vaultBaseURL, secretName, &max)
+	if err != nil {
+		log.Printf("Error getting secret versions: %v", err.Error())
+		return nil, classifyError(err)
+	}
+
+	for {
+		for _, value := range pages.Values() {
+			item := secrets.Secret{Name: secretName, ContentType: value.ContentType}
+			results = append(results, withSecretMetadata(item, keyvault.SecretBundle{
+				ID:         value.ID,
+				Tags:       value.Tags,
+				Attributes: value.Attributes,
+			}))
+		}
+
+		if !pages.NotDone() {
+			break
+		}
+		if err := pages.NextWithContext(ctx); err != nil {
+			return nil, classifyError(err)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Created == nil || results[j].Created == nil {
+			return results[j].Created == nil && results[i].Created != nil
+		}
+		return results[i].Created.After(*results[j].Created)
+	})
+
+	return results, nil
+}
+
+func (c KeyvaultClient) GetKey(ctx context.Context, vaultBaseURL string, keyName string, keyVersion string) (keys.Key, error) {
+	key, err := c.Client.GetKey(ctx, vaultBaseURL, keyName, keyVersion)
 	if err != nil {
 		log.Printf("Error getting key: %v", err.Error())
-		return keys.Key{}, err
+		return keys.Key{}, classifyError(err)
 	}
 
 	result := keys.Key(key)
@@ -173,11 +267,11 @@ func (c KeyvaultClient) GetKey(vaultBaseURL string, keyName string, keyVersion s
 	return result, err
 }
 
-func (c KeyvaultClient) getKeyByURL(keyURL string) (keys.Key, error) {
+func (c KeyvaultClient) getKeyByURL(ctx context.Context, keyURL string) (string, keys.Key, error) {
 	u, err := url.Parse(keyURL)
 	if err != nil {
 		log.Printf("Failed to parse URL for key: %v", err.Error())
-		return keys.Key{}, err
+		return "invalid", keys.Key{}, err
 	}
 	vaultBaseURL := fmt.Sprintf("%v://%v", u.Scheme, u.Host)
 
@@ -185,41 +279,90 @@ func (c KeyvaultClient) getKeyByURL(keyURL string) (keys.Key, error) {
 	res := regex.FindAllStringSubmatch(u.Path, -1)
 	keyName := res[0][1]
 
-	result, err := c.GetKey(vaultBaseURL, keyName, "")
+	result, err := c.GetKey(ctx, vaultBaseURL, keyName, "")
 	if err != nil {
 		log.Printf("Failed to get key from parsed values %v and %v: %v", vaultBaseURL, keyName, err.Error())
-		return keys.Key{}, err
+		return "invalid", keys.Key{}, err
 	}
 
-	return result, nil
+	return keyName, result, nil
 }
 
-func (c KeyvaultClient) GetKeys(vaultBaseURL string) (results []keys.Key, err error) {
+func (c KeyvaultClient) GetKeys(ctx context.Context, vaultBaseURL string) (results map[string]keys.Key, err error) {
 	max := int32(25)
-	pages, err := c.Client.GetKeys(context.Background(), vaultBaseURL, &max)
+	pages, err := c.Client.GetKeys(ctx, vaultBaseURL, &max)
+	results = make(map[string]keys.Key)
 	if err != nil {
 		log.Printf("Error getting key: %v", err.Error())
-		return nil, err
+		return map[string]keys.Key{}, classifyError(err)
 	}
 
 	for {
 		for _, value := range pages.Values() {
-			keyURL := *value.Kid
-			key, err := c.getKeyByURL(keyURL)
-			if err != nil {
-				log.Printf("Error loading key contents: %v", err.Error())
-				return nil, err
-			}
+			if value.Attributes == nil || value.Attributes.Enabled == nil || *value.Attributes.Enabled {
+				keyURL := *value.Kid
+				keyName, key, err := c.getKeyByURL(ctx, keyURL)
+				if err != nil {
+					log.Printf("Error loading key contents: %v", err.Error())
+					return nil, err
+				}
 
-			results = append(results, key)
+				results[keyName] = key
+			}
 		}
 
-		if pages.NotDone() {
-			pages.Next()
-		} else {
+		if !pages.NotDone() {
 			break
 		}
+		if err := pages.NextWithContext(ctx); err != nil {
+			return nil, classifyError(err)
+		}
 	}
 
 	return results, nil
 }
+
+// Encrypts key with the vault's RSA key keyName, returning the key version that wrapped it, which UnwrapKey needs
+func (c KeyvaultClient) WrapKey(ctx context.Context, vaultBaseURL string, keyName string, key []byte) (string, []byte, error) {
+	value := base64.RawURLEncoding.EncodeToString(key)
+	result, err := c.Client.WrapKey(ctx, vaultBaseURL, keyName, "", keyvault.KeyOperationsParameters{
+		Algorithm: keyvault.RSAOAEP256,
+		Value:     &value,
+	})
+	if err != nil {
+		log.Printf("Error wrapping key: %v", err.Error())
+		return "", nil, classifyError(err)
+	}
+	if result.Kid == nil || result.Result == nil {
+		return "", nil, fmt.Errorf("wrapping with key %v returned no result", keyName)
+	}
+
+	wrapped, err := decodeKeyOperationResult(*result.Result)
+	if err != nil {
+		return "", nil, err
+	}
+	return path.Base(*result.Kid), wrapped, nil
+}
+
+// Decrypts a key wrapped by WrapKey with the same key version
+func (c KeyvaultClient) UnwrapKey(ctx context.Context, vaultBaseURL string, keyName string, keyVersion string, wrapped []byte) ([]byte, error) {
+	value := base64.RawURLEncoding.EncodeToString(wrapped)
+	result, err := c.Client.UnwrapKey(ctx, vaultBaseURL, keyName, keyVersion, keyvault.KeyOperationsParameters{
+		Algorithm: keyvault.RSAOAEP256,
+		Value:     &value,
+	})
+	if err != nil {
+		log.Printf("Error unwrapping key: %v", err.Error())
+		return nil, classifyError(err)
+	}
+	if result.Result == nil {
+		return nil, fmt.Errorf("unwrapping with key %v returned no result", keyName)
+	}
+
+	return decodeKeyOperationResult(*result.Result)
+}
+
+// Key operation results are base64url, which the vault may or may not pad
+func decodeKeyOperationResult(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest/date"
+
+	"github.com/covermymeds/azure-key-vault-agent/secrets"
+)
+
+// Copies the version, tags and attributes of a Key Vault secret onto secret
+func withSecretMetadata(secret secrets.Secret, bundle keyvault.SecretBundle) secrets.Secret {
+	if bundle.ID != nil {
+		// IDs look like https://vault/secrets/<name>/<version>
+		parts := strings.Split(strings.TrimSuffix(*bundle.ID, "/"), "/")
+		secret.Version = parts[len(parts)-1]
+	}
+
+	if bundle.Tags != nil {
+		secret.Tags = make(map[string]string)
+		for key, value := range bundle.Tags {
+			if value != nil {
+				secret.Tags[key] = *value
+			}
+		}
+	}
+
+	if bundle.Attributes != nil {
+		secret.Enabled = bundle.Attributes.Enabled
+		secret.NotBefore = unixTime(bundle.Attributes.NotBefore)
+		secret.Expires = unixTime(bundle.Attributes.Expires)
+		secret.Created = unixTime(bundle.Attributes.Created)
+		secret.Updated = unixTime(bundle.Attributes.Updated)
+	}
+
+	return secret
+}
+
+func unixTime(t *date.UnixTime) *time.Time {
+	if t == nil {
+		return nil
+	}
+	result := time.Time(*t)
+	return &result
+}
+
+// Returns the versions in the secrets list of a Conjur variable resource, newest first
+func conjurVersions(resource map[string]interface{}) []int {
+	var results []int
+	items, _ := resource["secrets"].([]interface{})
+	for _, item := range items {
+		if entry, ok := item.(map[string]interface{}); ok {
+			if version, ok := entry["version"].(float64); ok {
+				results = append(results, int(version))
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(results)))
+	return results
+}
+
+// Returns the highest version of a Conjur variable resource
+func conjurLatestVersion(resource map[string]interface{}) string {
+	versions := conjurVersions(resource)
+	if len(versions) == 0 {
+		return ""
+	}
+	return strconv.Itoa(versions[0])
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/covermymeds/azure-key-vault-agent/config"
+	"github.com/covermymeds/azure-key-vault-agent/secrets"
+)
+
+// Remembers the secrets read by GetSecrets, so a secret is only read again once its listing shows a new version.
+// Shared by every worker using the same credential. Entries are kept per vault and filter, so resources listing the
+// same vault with different filters don't evict each other's secrets
+type secretCache struct {
+	mutex  sync.Mutex
+	scopes map[string]map[string]cachedSecret
+}
+
+type cachedSecret struct {
+	updated time.Time
+	secret  secrets.Secret
+}
+
+func newSecretCache() *secretCache {
+	return &secretCache{scopes: make(map[string]map[string]cachedSecret)}
+}
+
+// Identifies the secrets a listing of vaultBaseURL with filter returns. Only the fields that decide which secrets
+// match are used, as renaming doesn't change what is read
+func secretCacheScope(vaultBaseURL string, filter config.SecretFilterConfig) string {
+	return fmt.Sprintf("%v %q %q %q %v", vaultBaseURL, filter.Prefix, filter.Include, filter.Exclude, filter.Tags)
+}
+
+// Returns the cached secret for id if it was cached at the same updated time
+func (c *secretCache) get(scope string, id string, updated *time.Time) (secrets.Secret, bool) {
+	if c == nil || updated == nil {
+		return secrets.Secret{}, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.scopes[scope][id]
+	if !ok || !entry.updated.Equal(*updated) {
+		return secrets.Secret{}, false
+	}
+	return entry.secret, true
+}
+
+// Replaces the scope's entries with those of the latest complete listing, dropping secrets that were deleted,
+// disabled or no longer match the filter
+func (c *secretCache) replace(scope string, entries map[string]cachedSecret) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.scopes[scope] = entries
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+
+	"github.com/covermymeds/azure-key-vault-agent/config"
+)
+
+// How requests to a vault are sent
+type RequestOptions struct {
+	// Timeout for each attempt at a request
+	Timeout time.Duration
+	// Attempts at a throttled or transient failure before giving up, including the first
+	MaxAttempts int
+	RateLimit   config.RateLimitConfig
+}
+
+// Token buckets for each vault host. They're shared by every client, so workers using the same vault
+// through different credentials still stay under its limits together
+var limiters = struct {
+	sync.Mutex
+	hosts map[string]*rate.Limiter
+}{hosts: make(map[string]*rate.Limiter)}
+
+func hostLimiter(host string, rateLimit config.RateLimitConfig) *rate.Limiter {
+	limiters.Lock()
+	defer limiters.Unlock()
+
+	limit := rate.Limit(rateLimit.RequestsPerSecond)
+	limiter, ok := limiters.hosts[host]
+	if !ok {
+		limiter = rate.NewLimiter(limit, rateLimit.Burst)
+		limiters.hosts[host] = limiter
+	} else if limiter.Limit() != limit || limiter.Burst() != rateLimit.Burst {
+		// The config was reloaded with new limits
+		limiter.SetLimit(limit)
+		limiter.SetBurst(rateLimit.Burst)
+	}
+	return limiter
+}
+
+// Rate limits requests per host, gives each attempt its own timeout and retries throttled and transient failures,
+// waiting for Retry-After when the vault sends one
+type retryTransport struct {
+	base    http.RoundTripper
+	options RequestOptions
+}
+
+func newRetryTransport(base http.RoundTripper, options RequestOptions) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return retryTransport{base: base, options: options}
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	limiter := hostLimiter(req.URL.Host, t.options.RateLimit)
+	b := &backoff.Backoff{
+		Min:    500 * time.Millisecond,
+		Max:    30 * time.Second,
+		Factor: 2,
+		Jitter: true,
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		resp, err := t.send(req)
+		class := responseClass(resp, err)
+		if ctx.Err() != nil || (class != ErrThrottled && class != ErrTransient) {
+			return resp, err
+		}
+
+		if err == nil {
+			err = classifiedError{class: class, err: fmt.Errorf("%v %v returned %v", req.Method, req.URL.Redacted(), resp.Status)}
+		}
+		if attempt >= t.options.MaxAttempts || !rewindable(req) {
+			closeBody(resp)
+			return nil, fmt.Errorf("giving up after %v attempts: %w", attempt, err)
+		}
+
+		delay := retryAfter(resp)
+		if delay == 0 {
+			delay = b.Duration()
+		}
+		closeBody(resp)
+
+		log.WithFields(log.Fields{"event": "retry", "host": req.URL.Host, "class": class, "attempt": attempt}).
+			Printf("Retrying in %v: %v", delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+	}
+}
+
+// Makes one attempt at the request. The attempt's timeout covers reading the body, so it is only
+// released once the caller closes it
+func (t retryTransport) send(req *http.Request) (*http.Response, error) {
+	if t.options.Timeout <= 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.options.Timeout)
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if req.Context().Err() == nil && ctx.Err() != nil {
+			// Only this attempt ran out of time, so it's worth trying again
+			return nil, fmt.Errorf("%w: no response within %v", ErrTransient, t.options.Timeout)
+		}
+		return nil, err
+	}
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// A request can only be sent again if it has no body or the body can be recreated
+func rewindable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// Drains and closes the body so the connection can be reused
+func closeBody(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// Reads Retry-After as either seconds or an HTTP date, returning 0 if it is missing or already past
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && time.Until(at) > 0 {
+		return time.Until(at)
+	}
+	return 0
+}
@@ -0,0 +1,24 @@
+package config
+
+import "time"
+
+// An encrypted copy of the resources last fetched, used when the vaults can't be reached
+type CacheConfig struct {
+	Path string `yaml:"path,omitempty"`
+	// The encryption key is read from one of these
+	KeyFile           string `yaml:"keyFile,omitempty"`
+	SystemdCredential string `yaml:"systemdCredential,omitempty"`
+	// Or a random key is kept next to the cache, wrapped with this Key Vault key
+	KeyvaultKey CacheKeyvaultKeyConfig `yaml:"keyvaultKey,omitempty"`
+	MaxAge      string                 `yaml:"maxAge,omitempty"`
+
+	// Hold update values when parsed
+	TimeMaxAge time.Duration
+}
+
+// A Key Vault RSA key able to wrap and unwrap keys
+type CacheKeyvaultKeyConfig struct {
+	Credential   string `yaml:"credential,omitempty"`
+	VaultBaseURL string `yaml:"vaultBaseURL,omitempty"`
+	Name         string `yaml:"name,omitempty"`
+}
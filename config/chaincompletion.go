@@ -0,0 +1,14 @@
+package config
+
+import "time"
+
+// Where to find intermediates missing from certificate chains
+type ChainCompletionConfig struct {
+	CABundleDir string `yaml:"caBundleDir,omitempty"`
+	FetchAIA    bool   `yaml:"fetchAIA,omitempty"`
+	CacheDir    string `yaml:"cacheDir,omitempty"`
+	Timeout     string `yaml:"timeout,omitempty"`
+
+	// Hold update values when parsed
+	TimeTimeout time.Duration
+}
@@ -13,12 +13,18 @@ func (kvc CyberarkCredentialConfig) GetName() string {
 }
 
 type CyberarkResourceConfig struct {
-	Alias        string       `yaml:"alias,omitempty"`
-	Credential   string       `yaml:"credential,omitempty"`
-	Name         string       `yaml:"name"`
-	Version      string       `yaml:"version,omitempty"`
-	Kind         ResourceKind `yaml:"kind,omitempty" validate:"required,oneof=cyberark-secret all-cyberark-secrets"`
-	SafeName     string       `yaml:"safeName,omitempty" validate:"required"`
+	Alias             string                `yaml:"alias,omitempty"`
+	Credential        string                `yaml:"credential,omitempty"`
+	Name              string                `yaml:"name"`
+	Version           string                `yaml:"version,omitempty"`
+	PfxPasswordSecret string                `yaml:"pfxPasswordSecret,omitempty"`
+	VersionCount      int                   `yaml:"count,omitempty" validate:"gte=0"`
+	Kind              ResourceKind          `yaml:"kind,omitempty" validate:"required,oneof=cyberark-secret all-cyberark-secrets cyberark-secret-versions"`
+	SafeName          string                `yaml:"safeName,omitempty" validate:"required"`
+	FallbackVaults    []FallbackVaultConfig `yaml:"fallbackVaults,omitempty" validate:"dive"`
+
+	SecretFilterConfig `yaml:",inline"`
+	FailureConfig      `yaml:",inline"`
 }
 
 func (c CyberarkResourceConfig) GetName() string {
@@ -44,3 +50,28 @@ func (c CyberarkResourceConfig) GetAlias() string {
 func (c CyberarkResourceConfig) GetVersion() string {
 	return c.Version
 }
+
+func (c CyberarkResourceConfig) GetPfxPasswordSecret() string {
+	return c.PfxPasswordSecret
+}
+
+func (c CyberarkResourceConfig) GetSecretFilter() SecretFilterConfig {
+	return c.SecretFilterConfig
+}
+
+// Cyberark secrets have no expiry, so there is nothing to enforce
+func (c CyberarkResourceConfig) GetValidity() ValidityConfig {
+	return ValidityConfig{}
+}
+
+func (c CyberarkResourceConfig) GetVersionCount() int {
+	return c.VersionCount
+}
+
+func (c CyberarkResourceConfig) GetFailure() FailureConfig {
+	return c.FailureConfig
+}
+
+func (c CyberarkResourceConfig) GetFallbackVaults() []FallbackVaultConfig {
+	return c.FallbackVaults
+}
@@ -0,0 +1,19 @@
+package config
+
+// What happens when a resource can't be fetched
+type ErrorPolicy string
+
+const (
+	FailOnError  ErrorPolicy = "fail"
+	StaleOnError ErrorPolicy = "stale"
+)
+
+// How a resource that is missing or can't be fetched is handled
+type FailureConfig struct {
+	// A missing resource is left out instead of failing the cycle
+	Optional bool `yaml:"optional,omitempty"`
+	// Value used for a missing optional secret
+	Default *string `yaml:"default,omitempty"`
+	// Defaults to fail. stale keeps using the last value fetched when the vault is throttling or unreachable
+	OnError ErrorPolicy `yaml:"onError,omitempty" validate:"omitempty,oneof=fail stale"`
+}
@@ -0,0 +1,19 @@
+package config
+
+// A copy of a resource in another vault, tried when the resource's own vault is throttling or unreachable
+type FallbackVaultConfig struct {
+	// For Key Vault resources
+	VaultBaseURL string `yaml:"vaultBaseURL,omitempty" validate:"omitempty,url"`
+	// For Cyberark resources
+	SafeName string `yaml:"safeName,omitempty"`
+	// Defaults to the resource's credential
+	Credential string `yaml:"credential,omitempty"`
+}
+
+// The vault or safe to fetch from
+func (f FallbackVaultConfig) GetVault() string {
+	if f.SafeName != "" {
+		return f.SafeName
+	}
+	return f.VaultBaseURL
+}
@@ -12,12 +12,19 @@ func (kvc KeyvaultCredentialConfig) GetName() string {
 }
 
 type KeyvaultResourceConfig struct {
-	Alias        string       `yaml:"alias,omitempty"`
-	Credential   string       `yaml:"credential,omitempty"`
-	Name         string       `yaml:"name"`
-	Version      string       `yaml:"version,omitempty"`
-	Kind         ResourceKind `yaml:"kind,omitempty" validate:"required,oneof=cert key secret all-secrets"`
-	VaultBaseURL string       `yaml:"vaultBaseURL,omitempty" validate:"required,url"`
+	Alias             string                `yaml:"alias,omitempty"`
+	Credential        string                `yaml:"credential,omitempty"`
+	Name              string                `yaml:"name"`
+	Version           string                `yaml:"version,omitempty"`
+	PfxPasswordSecret string                `yaml:"pfxPasswordSecret,omitempty"`
+	VersionCount      int                   `yaml:"count,omitempty" validate:"gte=0"`
+	Kind              ResourceKind          `yaml:"kind,omitempty" validate:"required,oneof=cert key secret all-secrets all-certs all-keys secret-versions"`
+	VaultBaseURL      string                `yaml:"vaultBaseURL,omitempty" validate:"required,url"`
+	FallbackVaults    []FallbackVaultConfig `yaml:"fallbackVaults,omitempty" validate:"dive"`
+
+	SecretFilterConfig `yaml:",inline"`
+	FailureConfig      `yaml:",inline"`
+	ValidityConfig     `yaml:",inline"`
 }
 
 func (k KeyvaultResourceConfig) GetName() string {
@@ -43,3 +50,27 @@ func (k KeyvaultResourceConfig) GetAlias() string {
 func (k KeyvaultResourceConfig) GetVersion() string {
 	return k.Version
 }
+
+func (k KeyvaultResourceConfig) GetPfxPasswordSecret() string {
+	return k.PfxPasswordSecret
+}
+
+func (k KeyvaultResourceConfig) GetSecretFilter() SecretFilterConfig {
+	return k.SecretFilterConfig
+}
+
+func (k KeyvaultResourceConfig) GetValidity() ValidityConfig {
+	return k.ValidityConfig
+}
+
+func (k KeyvaultResourceConfig) GetVersionCount() int {
+	return k.VersionCount
+}
+
+func (k KeyvaultResourceConfig) GetFailure() FailureConfig {
+	return k.FailureConfig
+}
+
+func (k KeyvaultResourceConfig) GetFallbackVaults() []FallbackVaultConfig {
+	return k.FallbackVaults
+}
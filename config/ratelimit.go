@@ -0,0 +1,7 @@
+package config
+
+// How fast requests may be sent to each vault host, shared by every worker in the process
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `yaml:"requestsPerSecond,omitempty"`
+	Burst             int     `yaml:"burst,omitempty"`
+}
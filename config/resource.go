@@ -9,17 +9,27 @@ const (
 	KeyKind                ResourceKind = "key"
 	SecretKind             ResourceKind = "secret"
 	AllSecretsKind         ResourceKind = "all-secrets"
+	AllCertsKind           ResourceKind = "all-certs"
+	AllKeysKind            ResourceKind = "all-keys"
 	AllCyberarkSecretsKind ResourceKind = "all-cyberark-secrets"
 	CyberarkSecretKind     ResourceKind = "cyberark-secret"
+	SecretVersionsKind     ResourceKind = "secret-versions"
+	CyberarkVersionsKind   ResourceKind = "cyberark-secret-versions"
 )
 
 type GenericResource interface {
-	GetName()       string
-	GetCredential() string
-	GetKind()       ResourceKind
-	GetVault()      string
-	GetVersion()    string
-	GetAlias()      string
+	GetName()              string
+	GetCredential()        string
+	GetKind()              ResourceKind
+	GetVault()             string
+	GetVersion()           string
+	GetAlias()             string
+	GetPfxPasswordSecret() string
+	GetSecretFilter()      SecretFilterConfig
+	GetValidity()          ValidityConfig
+	GetVersionCount()      int
+	GetFailure()           FailureConfig
+	GetFallbackVaults()    []FallbackVaultConfig
 }
 
 type ResourceConfig struct {
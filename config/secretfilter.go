@@ -0,0 +1,21 @@
+package config
+
+// Narrows down the secrets an all-secrets resource fetches, and the keys they get in .Secrets. Applied to the
+// vault's list of secrets, so values are only fetched for secrets that match
+type SecretFilterConfig struct {
+	Prefix string `yaml:"prefix,omitempty"`
+	// Regular expressions the name must match at least one of
+	Include []string `yaml:"include,omitempty"`
+	// Regular expressions the name must match none of
+	Exclude []string `yaml:"exclude,omitempty"`
+	// Tags the secret must have, with these values
+	Tags map[string]string `yaml:"tags,omitempty"`
+	// Remove prefix from the names used as keys in .Secrets
+	StripPrefix bool `yaml:"stripPrefix,omitempty"`
+	// Added to the names used as keys in .Secrets, after stripPrefix
+	KeyPrefix string `yaml:"keyPrefix,omitempty"`
+}
+
+func (f SecretFilterConfig) IsEmpty() bool {
+	return f.Prefix == "" && len(f.Include) == 0 && len(f.Exclude) == 0 && len(f.Tags) == 0 && !f.StripPrefix && f.KeyPrefix == ""
+}
@@ -2,16 +2,42 @@ package config
 
 import "os"
 
+type Format string
+
+const (
+	JsonFormat       Format = "json"
+	YamlFormat       Format = "yaml"
+	DotenvFormat     Format = "dotenv"
+	PropertiesFormat Format = "properties"
+	TomlFormat       Format = "toml"
+	IniFormat        Format = "ini"
+)
+
+// Rules for turning secret names into keys in a formatted sink
+type SinkKeysConfig struct {
+	Rename      map[string]string `yaml:"rename,omitempty"`
+	StripPrefix bool              `yaml:"stripPrefix,omitempty"`
+	Replace     map[string]string `yaml:"replace,omitempty"`
+	Case        string            `yaml:"case,omitempty" validate:"omitempty,oneof=upper lower"`
+}
+
 type SinkConfig struct {
-	Path         string `yaml:"path,omitempty" validate:"required"`
-	Template     string `yaml:"template,omitempty"`
-	TemplatePath string `yaml:"templatePath,omitempty"`
-	Owner        string `yaml:"owner,omitempty" validate:"required_with=Group"`
-	Group        string `yaml:"group,omitempty" validate:"required_with=Owner"`
-	Mode         string `yaml:"mode,omitempty" validate:"fileMode"`
+	Path         string         `yaml:"path,omitempty" validate:"required"`
+	Template     string         `yaml:"template,omitempty"`
+	TemplatePath string         `yaml:"templatePath,omitempty"`
+	Owner        string         `yaml:"owner,omitempty" validate:"required_with=Group"`
+	Group        string         `yaml:"group,omitempty" validate:"required_with=Owner"`
+	Mode         string         `yaml:"mode,omitempty" validate:"fileMode"`
+	Format       Format         `yaml:"format,omitempty" validate:"omitempty,oneof=json yaml dotenv properties toml ini"`
+	Names        []string       `yaml:"names,omitempty"`
+	Prefix       string         `yaml:"prefix,omitempty"`
+	Keys         SinkKeysConfig `yaml:"keys,omitempty"`
 
 	// Hold update values when parsed
-	UID          uint32
-	GID          uint32
-	FileMode     os.FileMode
-}
\ No newline at end of file
+	UID              uint32
+	GID              uint32
+	FileMode         os.FileMode
+	Partials         map[string]string
+	BlockedFunctions map[string]bool
+	ChainCompletion  ChainCompletionConfig
+}
@@ -0,0 +1,8 @@
+package config
+
+// Controls which functions templates may call
+type TemplateFunctionsConfig struct {
+	Profile string   `yaml:"profile,omitempty" validate:"omitempty,oneof=hardened permissive"`
+	Allow   []string `yaml:"allow,omitempty"`
+	Deny    []string `yaml:"deny,omitempty"`
+}
@@ -0,0 +1,14 @@
+package config
+
+// Checks the rendered certificate and private key belong together and are usable before any sink is written
+type TLSCheckConfig struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Paths of the sinks holding the certificate, its key and optionally a separate chain.
+	// If unset, the first sink containing a certificate or private key is used
+	CertSink  string `yaml:"certSink,omitempty"`
+	KeySink   string `yaml:"keySink,omitempty"`
+	ChainSink string `yaml:"chainSink,omitempty"`
+	// A PEM file or directory of certificates to verify the chain against, instead of the system roots
+	TrustStore string `yaml:"trustStore,omitempty"`
+	SkipChain  bool   `yaml:"skipChain,omitempty"`
+}
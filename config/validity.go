@@ -0,0 +1,20 @@
+package config
+
+// What happens when a fetched secret or cert has expired
+type ExpiredPolicy string
+
+const (
+	FailOnExpired  ExpiredPolicy = "fail"
+	WarnOnExpired  ExpiredPolicy = "warn"
+	AllowOnExpired ExpiredPolicy = "allow"
+)
+
+// How a resource's enabled, not before and expiry attributes are enforced
+type ValidityConfig struct {
+	// Defaults to warn
+	OnExpired ExpiredPolicy `yaml:"onExpired,omitempty" validate:"omitempty,oneof=fail warn allow"`
+	// Use the newest version that is already valid while the latest version's not before date is in the future
+	RespectNotBefore bool `yaml:"respectNotBefore,omitempty"`
+	// Log an expiring event on every cycle within this many days of expiry
+	ExpiryWarningDays int `yaml:"expiryWarningDays,omitempty" validate:"gte=0"`
+}
@@ -5,10 +5,38 @@ import (
 )
 
 type WorkerConfig struct {
-	Resources     []ResourceConfig `yaml:"resources" validate:"required,dive,required"`
-	Frequency     string           `yaml:"frequency,omitempty"`
-	TimeFrequency time.Duration    `yaml:"timefrequency" validate:"-"`
-	PreChange     string           `yaml:"preChange,omitempty"`
-	PostChange    string           `yaml:"postChange,omitempty"`
-	Sinks         []SinkConfig     `yaml:"sinks" validate:"required,dive,required"`
+	Resources        []ResourceConfig       `yaml:"resources" validate:"resources,dive,required"`
+	Frequency        string                 `yaml:"frequency,omitempty"`
+	TimeFrequency    time.Duration          `yaml:"timefrequency" validate:"-"`
+	CycleTimeout     string                 `yaml:"cycleTimeout,omitempty"`
+	TimeCycleTimeout time.Duration          `yaml:"timecycletimeout" validate:"-"`
+	PreChange        string                 `yaml:"preChange,omitempty"`
+	PostChange       string                 `yaml:"postChange,omitempty"`
+	Sinks            []SinkConfig           `yaml:"sinks" validate:"required,dive,required"`
+	DynamicResources DynamicResourcesConfig `yaml:"dynamicResources,omitempty"`
+	TLSCheck         TLSCheckConfig         `yaml:"tlsCheck,omitempty"`
+	SecretConflicts  ConflictPolicy         `yaml:"secretConflicts,omitempty" validate:"omitempty,oneof=error first last"`
+}
+
+// What happens when two resources put a secret under the same key in .Secrets
+type ConflictPolicy string
+
+const (
+	ErrorOnConflict ConflictPolicy = "error"
+	FirstWins       ConflictPolicy = "first"
+	LastWins        ConflictPolicy = "last"
+)
+
+// Lets templates fetch secrets with kvSecret and conjurSecret instead of declaring them as resources
+type DynamicResourcesConfig struct {
+	Enabled            bool   `yaml:"enabled,omitempty"`
+	Credential         string `yaml:"credential,omitempty"`
+	CyberarkCredential string `yaml:"cyberarkCredential,omitempty"`
+	// Reuse a fetched secret across cycles for this long instead of fetching it every cycle
+	CacheFor     string        `yaml:"cacheFor,omitempty"`
+	TimeCacheFor time.Duration `yaml:"timecachefor" validate:"-"`
+
+	// Applied to every secret the templates request, as if each was declared under resources
+	FailureConfig  `yaml:",inline"`
+	ValidityConfig `yaml:",inline"`
 }
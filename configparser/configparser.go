@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"os/user"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"time"
@@ -14,14 +15,25 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"github.com/covermymeds/azure-key-vault-agent/config"
+	"github.com/covermymeds/azure-key-vault-agent/templaterenderer"
 	"github.com/gobuffalo/envy"
 )
 
 var validate *validator.Validate
 
 type Config struct {
-	Credentials []config.CredentialConfig
-	Workers     []config.WorkerConfig
+	Credentials       []config.CredentialConfig
+	Workers           []config.WorkerConfig
+	TemplateDirs      []string                       `yaml:"templateDirs,omitempty"`
+	TemplateFunctions config.TemplateFunctionsConfig `yaml:"templateFunctions,omitempty"`
+	ChainCompletion   config.ChainCompletionConfig   `yaml:"chainCompletion,omitempty"`
+	RequestTimeout    string                         `yaml:"requestTimeout,omitempty"`
+	MaxAttempts       int                            `yaml:"maxAttempts,omitempty"`
+	RateLimit         config.RateLimitConfig         `yaml:"rateLimit,omitempty"`
+	Cache             config.CacheConfig             `yaml:"cache,omitempty"`
+
+	// Hold update values when parsed
+	TimeRequestTimeout time.Duration
 }
 
 func ParseConfig(path string) Config {
@@ -41,7 +53,32 @@ func ParseConfig(path string) Config {
 
 	validateCredentialConfigs(config.Credentials)
 
-	parseWorkerConfigs(config)
+	blocked := parseTemplateFunctions(config.TemplateFunctions)
+
+	partials := templaterenderer.LoadPartials(config.TemplateDirs, blocked)
+
+	config.ChainCompletion = parseChainCompletion(config.ChainCompletion)
+
+	// Long enough for a slow vault, short enough that a hung connection doesn't stall a worker indefinitely
+	config.TimeRequestTimeout = 30 * time.Second
+	if config.RequestTimeout != "" {
+		config.TimeRequestTimeout = parseTimeout("requestTimeout", config.RequestTimeout)
+	}
+
+	if config.MaxAttempts < 0 {
+		panic(fmt.Sprintf("Error parsing config: invalid maxAttempts %v", config.MaxAttempts))
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = 4
+	}
+
+	config.RateLimit = parseRateLimit(config.RateLimit)
+
+	if config.Cache.Path != "" {
+		config.Cache = parseCache(config, config.Cache)
+	}
+
+	parseWorkerConfigs(config, partials, blocked)
 
 	return config
 }
@@ -60,6 +97,16 @@ func ValidateFileMode(fl validator.FieldLevel) bool {
 	return matched
 }
 
+// Resources can only be left out when templates fetch their own secrets
+func ValidateResources(fl validator.FieldLevel) bool {
+	workerConfig, ok := fl.Parent().Interface().(config.WorkerConfig)
+	if ok && workerConfig.DynamicResources.Enabled {
+		return true
+	}
+
+	return fl.Field().Len() > 0
+}
+
 func defaultCredentials() []config.CredentialConfig {
 	tenantID := envy.Get("AZURE_TENANT_ID", "")
 	clientID := envy.Get("AZURE_CLIENT_ID", "")
@@ -134,9 +181,52 @@ func validateCredentialConfigs(credentialConfigs []config.CredentialConfig) {
 	}
 }
 
-func parseWorkerConfigs(config Config) {
+func parseTemplateFunctions(templateFunctions config.TemplateFunctionsConfig) map[string]bool {
+	validate = validator.New()
+
+	err := validate.Struct(templateFunctions)
+	if err != nil {
+		panic(fmt.Sprintf("Error parsing templateFunctions: %v", err))
+	}
+
+	return templaterenderer.BlockedFunctions(templateFunctions)
+}
+
+func parseChainCompletion(chainCompletion config.ChainCompletionConfig) config.ChainCompletionConfig {
+	if chainCompletion.CABundleDir != "" {
+		info, err := os.Stat(chainCompletion.CABundleDir)
+		if err != nil {
+			panic(fmt.Sprintf("Error parsing chainCompletion: %v", err))
+		}
+		if !info.IsDir() {
+			panic(fmt.Sprintf("Error parsing chainCompletion: caBundleDir %v is not a directory", chainCompletion.CABundleDir))
+		}
+	}
+
+	// AIA fetches happen while rendering, so don't let a slow CA hold up the worker for long
+	chainCompletion.TimeTimeout = 10 * time.Second
+	if chainCompletion.Timeout != "" {
+		timeout, err := time.ParseDuration(chainCompletion.Timeout)
+		if err != nil {
+			panic(fmt.Sprintf("Error parsing chainCompletion: invalid timeout %v", chainCompletion.Timeout))
+		}
+		chainCompletion.TimeTimeout = timeout
+	}
+
+	return chainCompletion
+}
+
+// The kinds that fetch everything in a vault, and the single resource kind each one overwrites. all-secrets
+// and all-cyberark-secrets aren't listed, as secretConflicts decides how they combine with single secrets
+var allKinds = map[config.ResourceKind]config.ResourceKind{
+	config.AllCertsKind: config.CertKind,
+	config.AllKeysKind:  config.KeyKind,
+}
+
+func parseWorkerConfigs(config Config, partials map[string]string, blocked map[string]bool) {
 	validate = validator.New()
 	validate.RegisterValidation("fileMode", ValidateFileMode)
+	validate.RegisterValidation("resources", ValidateResources)
 
 	for i, workerConfig := range config.Workers {
 		err := validate.Struct(workerConfig)
@@ -147,6 +237,18 @@ func parseWorkerConfigs(config Config) {
 		// Convert human readable time and save into TimeFrequency
 		config.Workers[i].TimeFrequency = frequencyConverter(workerConfig.Frequency)
 
+		if workerConfig.CycleTimeout != "" {
+			config.Workers[i].TimeCycleTimeout = parseTimeout("cycleTimeout", workerConfig.CycleTimeout)
+		}
+
+		if len(workerConfig.Resources) == 0 && !workerConfig.DynamicResources.Enabled {
+			panic("Error parsing worker config: resources is required unless dynamicResources is enabled")
+		}
+
+		if workerConfig.DynamicResources.Enabled {
+			config.Workers[i].DynamicResources = parseDynamicResources(config, workerConfig.DynamicResources)
+		}
+
 		// Check each resourceConfig in the workerConfig
 		configMap := make(map[string]int)
 		for j, _ := range workerConfig.Resources {
@@ -154,42 +256,215 @@ func parseWorkerConfigs(config Config) {
 			resourceCredential := config.Workers[i].Resources[j].GetCredential()
 			resourceVault := config.Workers[i].Resources[j].GetVault()
 
-			_, ok := configMap[resourceVault]
-			if !ok {
-				configMap[resourceVault] = 0
+			// Track single and all-* cert and key resources per vault, as one would overwrite the other
+			_, isAll := allKinds[resourceKind]
+			allKind := resourceKind
+			for kind, single := range allKinds {
+				if single == resourceKind {
+					allKind = kind
+				}
 			}
-			if resourceKind == "secret" || resourceKind == "cyberark-secret" {
-				configMap[resourceVault] |= 1
+			if _, tracked := allKinds[allKind]; tracked {
+				usageKey := fmt.Sprintf("%v %v", allKind, resourceVault)
+				if isAll {
+					configMap[usageKey] |= 2
+				} else {
+					configMap[usageKey] |= 1
+				}
+				if configMap[usageKey] == 3 {
+					panic(fmt.Sprintf("Error parsing worker config: %v resource will overwrite %vs. Please only use one or the other for the vault at %s", allKind, allKinds[allKind], resourceVault))
+				}
 			}
-			if resourceKind == "all-secrets" || resourceKind == "all-cyberark-secrets" {
-				configMap[resourceVault] |= 2
+
+			fetchesAll := isAll || resourceKind == "all-secrets" || resourceKind == "all-cyberark-secrets"
+			if !fetchesAll && config.Workers[i].Resources[j].GetName() == "" {
+				panic(fmt.Sprintf("Error parsing worker config: Name is required for %v resource", resourceKind))
 			}
-			if configMap[resourceVault] == 3 {
-				panic(fmt.Sprintf("Error parsing worker config: all-secrets resource will overwrite secrets. Please only use one or the other for the vault at %s", resourceVault))
+
+			if config.Workers[i].Resources[j].GetPfxPasswordSecret() != "" && !(resourceKind == "secret" || resourceKind == "cyberark-secret") {
+				panic(fmt.Sprintf("Error parsing worker config: pfxPasswordSecret is only supported for secret and cyberark-secret resources, not %v", resourceKind))
 			}
 
-			if !(resourceKind == "all-secrets" || resourceKind == "all-cyberark-secrets") && config.Workers[i].Resources[j].GetName() == "" {
-				panic(fmt.Sprintf("Error parsing worker config: Name is required for %v resource", resourceKind))
+			isVersions := resourceKind == "secret-versions" || resourceKind == "cyberark-secret-versions"
+			if config.Workers[i].Resources[j].GetVersion() != "" && isVersions {
+				panic(fmt.Sprintf("Error parsing worker config: version can't be used with %v resources, use count instead", resourceKind))
+			}
+			if config.Workers[i].Resources[j].GetVersionCount() != 0 && !isVersions {
+				panic(fmt.Sprintf("Error parsing worker config: count is only supported for secret-versions and cyberark-secret-versions resources, not %v", resourceKind))
 			}
 
-			// Confirm that a Credential by this name exists
-			found := false
-			for _, credential := range config.Credentials {
-				if credential.GetName() == resourceCredential {
-					found = true
-					break
-				}
+			if config.Workers[i].Resources[j].GetValidity().RespectNotBefore && !(resourceKind == "secret" || resourceKind == "all-secrets") {
+				panic(fmt.Sprintf("Error parsing worker config: respectNotBefore is only supported for secret and all-secrets resources, not %v", resourceKind))
+			}
+
+			for k, fallback := range config.Workers[i].Resources[j].GetFallbackVaults() {
+				config.Workers[i].Resources[j].GetFallbackVaults()[k] = parseFallbackVault(config, config.Workers[i].Resources[j], fallback)
+			}
+
+			failure := config.Workers[i].Resources[j].GetFailure()
+			if failure.Default != nil && !failure.Optional {
+				panic(fmt.Sprintf("Error parsing worker config: default requires optional for %v resource %v", resourceKind, config.Workers[i].Resources[j].GetName()))
+			}
+			if failure.Default != nil && !(resourceKind == "secret" || resourceKind == "cyberark-secret") {
+				panic(fmt.Sprintf("Error parsing worker config: default is only supported for secret and cyberark-secret resources, not %v", resourceKind))
+			}
+
+			filter := config.Workers[i].Resources[j].GetSecretFilter()
+			if !filter.IsEmpty() {
+				parseSecretFilter(resourceKind, filter)
 			}
-			if !found {
+
+			// Confirm that a Credential by this name exists
+			if !credentialExists(config, resourceCredential) {
 				panic(fmt.Sprintf("Error parsing worker config: credential %v not found", resourceCredential))
 			}
 		}
 
+		if workerConfig.TLSCheck.Enabled {
+			parseTLSCheck(workerConfig)
+		}
+
 		// Check each sinkConfig in the workerConfig
 		for j, sinkConfig := range workerConfig.Sinks {
 			config.Workers[i].Sinks[j] = parseSinkConfig(sinkConfig)
+			config.Workers[i].Sinks[j].Partials = partials
+			config.Workers[i].Sinks[j].BlockedFunctions = blocked
+			config.Workers[i].Sinks[j].ChainCompletion = config.ChainCompletion
+		}
+	}
+}
+
+func parseSecretFilter(resourceKind config.ResourceKind, filter config.SecretFilterConfig) {
+	if resourceKind == config.AllCyberarkSecretsKind {
+		nameOnly := filter
+		nameOnly.KeyPrefix = ""
+		if !nameOnly.IsEmpty() {
+			panic("Error parsing worker config: only keyPrefix is supported for all-cyberark-secrets resources")
+		}
+	} else if resourceKind != config.AllSecretsKind {
+		panic(fmt.Sprintf("Error parsing worker config: prefix, include, exclude, tags, stripPrefix and keyPrefix are only supported for all-secrets resources, not %v", resourceKind))
+	}
+
+	if filter.StripPrefix && filter.Prefix == "" {
+		panic("Error parsing worker config: stripPrefix requires prefix")
+	}
+
+	for _, pattern := range append(append([]string{}, filter.Include...), filter.Exclude...) {
+		if _, err := regexp.Compile(pattern); err != nil {
+			panic(fmt.Sprintf("Error parsing worker config: invalid pattern %v: %v", pattern, err))
+		}
+	}
+}
+
+func parseTLSCheck(workerConfig config.WorkerConfig) {
+	sinkPaths := make(map[string]bool)
+	for _, sinkConfig := range workerConfig.Sinks {
+		sinkPaths[sinkConfig.Path] = true
+	}
+
+	tlsCheck := workerConfig.TLSCheck
+	for _, path := range []string{tlsCheck.CertSink, tlsCheck.KeySink, tlsCheck.ChainSink} {
+		if path != "" && !sinkPaths[path] {
+			panic(fmt.Sprintf("Error parsing tlsCheck: %v is not a sink of this worker", path))
 		}
 	}
+
+	if tlsCheck.TrustStore != "" {
+		if _, err := os.Stat(tlsCheck.TrustStore); err != nil {
+			panic(fmt.Sprintf("Error parsing tlsCheck: %v", err))
+		}
+	}
+}
+
+func parseDynamicResources(config Config, dynamicConfig config.DynamicResourcesConfig) config.DynamicResourcesConfig {
+	// Checked like a resource's credential, except a default that doesn't exist only rules out its kind of secret
+	credentialType := func(name string) string {
+		for _, credential := range config.Credentials {
+			if credential.GetName() == name {
+				return fmt.Sprintf("%T", credential.CredConfig)
+			}
+		}
+		return ""
+	}
+
+	if dynamicConfig.Credential == "" {
+		if credentialExists(config, "default") {
+			dynamicConfig.Credential = "default"
+		}
+	} else if !credentialExists(config, dynamicConfig.Credential) {
+		panic(fmt.Sprintf("Error parsing worker config: dynamicResources credential %v not found", dynamicConfig.Credential))
+	}
+	if dynamicConfig.Credential != "" && credentialType(dynamicConfig.Credential) != "config.KeyvaultCredentialConfig" {
+		panic(fmt.Sprintf("Error parsing worker config: dynamicResources credential %v is not a Key Vault credential", dynamicConfig.Credential))
+	}
+
+	if dynamicConfig.CyberarkCredential == "" {
+		if credentialExists(config, "default_cyberark") {
+			dynamicConfig.CyberarkCredential = "default_cyberark"
+		}
+	} else if !credentialExists(config, dynamicConfig.CyberarkCredential) {
+		panic(fmt.Sprintf("Error parsing worker config: dynamicResources cyberarkCredential %v not found", dynamicConfig.CyberarkCredential))
+	}
+	if dynamicConfig.CyberarkCredential != "" && credentialType(dynamicConfig.CyberarkCredential) != "config.CyberarkCredentialConfig" {
+		panic(fmt.Sprintf("Error parsing worker config: dynamicResources cyberarkCredential %v is not a Cyberark credential", dynamicConfig.CyberarkCredential))
+	}
+
+	if dynamicConfig.Credential == "" && dynamicConfig.CyberarkCredential == "" {
+		panic("Error parsing worker config: dynamicResources needs a credential or cyberarkCredential, and neither default credential was found")
+	}
+
+	if dynamicConfig.Default != nil && !dynamicConfig.Optional {
+		panic("Error parsing worker config: default requires optional for dynamicResources")
+	}
+
+	if dynamicConfig.CacheFor != "" {
+		dynamicConfig.TimeCacheFor = parseTimeout("dynamicResources cacheFor", dynamicConfig.CacheFor)
+	}
+
+	return dynamicConfig
+}
+
+func parseFallbackVault(parsedConfig Config, resourceConfig config.ResourceConfig, fallback config.FallbackVaultConfig) config.FallbackVaultConfig {
+	if fallback.Credential == "" {
+		fallback.Credential = resourceConfig.GetCredential()
+	}
+
+	_, isCyberark := resourceConfig.GenericResource.(config.CyberarkResourceConfig)
+	if isCyberark && (fallback.SafeName == "" || fallback.VaultBaseURL != "") {
+		panic(fmt.Sprintf("Error parsing worker config: fallbackVaults for %v must set safeName", resourceConfig.GetName()))
+	}
+	if !isCyberark && (fallback.VaultBaseURL == "" || fallback.SafeName != "") {
+		panic(fmt.Sprintf("Error parsing worker config: fallbackVaults for %v must set vaultBaseURL", resourceConfig.GetName()))
+	}
+
+	// The fallback's client has to speak the same API as the resource's
+	var credential, resourceCredential config.CredentialConfig
+	for _, c := range parsedConfig.Credentials {
+		if c.GetName() == fallback.Credential {
+			credential = c
+		}
+		if c.GetName() == resourceConfig.GetCredential() {
+			resourceCredential = c
+		}
+	}
+	if credential.CredConfig == nil {
+		panic(fmt.Sprintf("Error parsing worker config: credential %v not found", fallback.Credential))
+	}
+	if fmt.Sprintf("%T", credential.CredConfig) != fmt.Sprintf("%T", resourceCredential.CredConfig) {
+		panic(fmt.Sprintf("Error parsing worker config: fallback credential %v for %v is not the same type as %v",
+			fallback.Credential, resourceConfig.GetName(), resourceConfig.GetCredential()))
+	}
+
+	return fallback
+}
+
+func credentialExists(config Config, name string) bool {
+	for _, credential := range config.Credentials {
+		if credential.GetName() == name {
+			return true
+		}
+	}
+	return false
 }
 
 func parseSinkConfig(sinkConfig config.SinkConfig) config.SinkConfig {
@@ -198,6 +473,19 @@ func parseSinkConfig(sinkConfig config.SinkConfig) config.SinkConfig {
 		panic("Template and TemplatePath cannot both be defined")
 	}
 
+	// Format replaces the template entirely
+	if sinkConfig.Format != "" && (sinkConfig.Template != "" || sinkConfig.TemplatePath != "") {
+		panic("Format cannot be defined together with Template or TemplatePath")
+	}
+
+	if sinkConfig.Format == "" && (len(sinkConfig.Names) > 0 || sinkConfig.Prefix != "") {
+		panic("Names and Prefix can only be used with Format")
+	}
+
+	if sinkConfig.Keys.StripPrefix && sinkConfig.Prefix == "" {
+		panic("Keys.StripPrefix requires Prefix")
+	}
+
 	// Parse the Ownership
 	sinkConfig = parseSinkOwnership(sinkConfig)
 
@@ -292,6 +580,83 @@ func parseSinkOwnership(sinkConfig config.SinkConfig) config.SinkConfig {
 	return sinkConfig
 }
 
+func parseCache(parsedConfig Config, cache config.CacheConfig) config.CacheConfig {
+	sources := 0
+	for _, source := range []string{cache.KeyFile, cache.SystemdCredential, cache.KeyvaultKey.Name} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		panic("Error parsing cache: set one of keyFile, systemdCredential or keyvaultKey")
+	}
+
+	if cache.KeyvaultKey.Name != "" {
+		cache.KeyvaultKey = parseCacheKeyvaultKey(parsedConfig, cache.KeyvaultKey)
+	}
+
+	info, err := os.Stat(filepath.Dir(cache.Path))
+	if err != nil {
+		panic(fmt.Sprintf("Error parsing cache: %v", err))
+	}
+	if !info.IsDir() {
+		panic(fmt.Sprintf("Error parsing cache: %v is not a directory", filepath.Dir(cache.Path)))
+	}
+
+	// Long enough to ride out a vault outage overnight, short enough that a host offline for days doesn't come up
+	// with secrets that have since been rotated
+	cache.TimeMaxAge = 24 * time.Hour
+	if cache.MaxAge != "" {
+		cache.TimeMaxAge = parseTimeout("maxAge", cache.MaxAge)
+	}
+
+	return cache
+}
+
+func parseCacheKeyvaultKey(parsedConfig Config, key config.CacheKeyvaultKeyConfig) config.CacheKeyvaultKeyConfig {
+	if key.VaultBaseURL == "" {
+		panic("Error parsing cache: keyvaultKey requires vaultBaseURL")
+	}
+
+	if key.Credential == "" {
+		key.Credential = "default"
+	}
+	for _, credential := range parsedConfig.Credentials {
+		if credential.GetName() != key.Credential {
+			continue
+		}
+		if _, ok := credential.CredConfig.(config.KeyvaultCredentialConfig); !ok {
+			panic(fmt.Sprintf("Error parsing cache: keyvaultKey credential %v is not a Key Vault credential", key.Credential))
+		}
+		return key
+	}
+	panic(fmt.Sprintf("Error parsing cache: keyvaultKey credential %v not found", key.Credential))
+}
+
+func parseRateLimit(rateLimit config.RateLimitConfig) config.RateLimitConfig {
+	if rateLimit.RequestsPerSecond < 0 || rateLimit.Burst < 0 {
+		panic("Error parsing rateLimit: requestsPerSecond and burst can't be negative")
+	}
+
+	// Well under Key Vault's limit of 4000 secret reads per 10 seconds, which is shared with every other client of the vault
+	if rateLimit.RequestsPerSecond == 0 {
+		rateLimit.RequestsPerSecond = 100
+	}
+	if rateLimit.Burst == 0 {
+		rateLimit.Burst = 20
+	}
+
+	return rateLimit
+}
+
+func parseTimeout(field string, timeout string) time.Duration {
+	parsed, err := time.ParseDuration(timeout)
+	if err != nil || parsed <= 0 {
+		panic(fmt.Sprintf("Error parsing config: invalid %v %v", field, timeout))
+	}
+	return parsed
+}
+
 func frequencyConverter(freq string) time.Duration {
 	readabletime, _ := time.ParseDuration(freq)
 
@@ -2,12 +2,14 @@ package configwatcher
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"path/filepath"
 
 	"github.com/covermymeds/azure-key-vault-agent/client"
 	"github.com/covermymeds/azure-key-vault-agent/config"
 	"github.com/covermymeds/azure-key-vault-agent/configparser"
+	"github.com/covermymeds/azure-key-vault-agent/diskcache"
 	"github.com/covermymeds/azure-key-vault-agent/worker"
 	"github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
@@ -40,14 +42,19 @@ func Watcher(path string) {
 
 func initializeClients(parsedConfig configparser.Config) client.Clients{
 	clients := make(client.Clients)
+	options := client.RequestOptions{
+		Timeout:     parsedConfig.TimeRequestTimeout,
+		MaxAttempts: parsedConfig.MaxAttempts,
+		RateLimit:   parsedConfig.RateLimit,
+	}
 	for _, credentialConfig := range parsedConfig.Credentials {
 		switch t := credentialConfig.CredConfig.(type) {
 		case config.KeyvaultCredentialConfig:
 			kvc := credentialConfig.CredConfig.(config.KeyvaultCredentialConfig)
-			clients[credentialConfig.GetName()] = client.NewKeyvaultClient(kvc)
+			clients[credentialConfig.GetName()] = client.NewKeyvaultClient(kvc, options)
 		case config.CyberarkCredentialConfig:
 			cc := credentialConfig.CredConfig.(config.CyberarkCredentialConfig)
-			clients[credentialConfig.GetName()] = client.NewCyberarkClient(cc)
+			clients[credentialConfig.GetName()] = client.NewCyberarkClient(cc, options)
 		default:
 			panic(fmt.Sprintf("Got unexpected type: %v", t))
 		}
@@ -55,17 +62,43 @@ func initializeClients(parsedConfig configparser.Config) client.Clients{
 
 	return clients
 }
+
+// Opens the on-disk cache for the workers, if one is configured
+func initializeCache(parsedConfig configparser.Config, clients client.Clients) {
+	if parsedConfig.Cache.Path == "" {
+		worker.UseCache(nil)
+		return
+	}
+
+	var wrapper diskcache.KeyWrapper
+	if credential := parsedConfig.Cache.KeyvaultKey.Credential; credential != "" {
+		wrapper, _ = clients[credential].(diskcache.KeyWrapper)
+	}
+
+	cache, err := diskcache.Open(parsedConfig.Cache, wrapper)
+	if errors.Is(err, diskcache.ErrKeyUnavailable) {
+		// The agent can still run without the cache, it just can't ride out an outage
+		log.Warnf("Not using cache %v: %v", parsedConfig.Cache.Path, err)
+		worker.UseCache(nil)
+		return
+	}
+	if err != nil {
+		panic(fmt.Sprintf("Error opening cache: %v", err))
+	}
+	worker.UseCache(cache)
+}
 func ParseAndRunWorkersOnce(path string) {
 	// Parse config file
 	parsedConfig := configparser.ParseConfig(path)
 
 	// Initialize clients
 	clients := initializeClients(parsedConfig)
+	initializeCache(parsedConfig, clients)
 
 	// Start workers
 	log.Printf("Running workers once")
 	for _, workerConfig := range parsedConfig.Workers {
-		err := worker.Process(nil, clients, workerConfig)
+		err := worker.Process(context.Background(), clients, workerConfig)
 		if err != nil {
 			log.Fatalf("Failed to get resource(s): %v", err)
 		}
@@ -81,6 +114,7 @@ func parseAndStartWorkers(path string) context.CancelFunc {
 
 	// Initialize clients
 	clients := initializeClients(parsedConfig)
+	initializeCache(parsedConfig, clients)
 
 	// Start workers
 	for _, workerConfig := range parsedConfig.Workers {
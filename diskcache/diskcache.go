@@ -0,0 +1,200 @@
+package diskcache
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/covermymeds/azure-key-vault-agent/config"
+)
+
+// Written before the encrypted entries, and authenticated along with them
+const header = "akva-cache-v1\n"
+
+// A resource as it was last fetched
+type entry struct {
+	Value     json.RawMessage `json:"value"`
+	Source    string          `json:"source"`
+	FetchedAt time.Time       `json:"fetchedAt"`
+}
+
+// The last value fetched for each resource, kept in an AES-256-GCM encrypted file so it survives restarts.
+// Entries are changed in memory by Put and written out by Flush
+type Cache struct {
+	path   string
+	maxAge time.Duration
+	aead   cipher.AEAD
+
+	mu      sync.Mutex
+	entries map[string]entry
+	// Set when a value changed or an entry was dropped since the file was written
+	dirty bool
+	// When the file was last written, which is how old the fetch times in it may be
+	writtenAt time.Time
+}
+
+// Loads the cache file, starting empty if it doesn't exist yet or can't be decrypted. wrapper is only used with
+// keyvaultKey, and may be nil otherwise
+func Open(cacheConfig config.CacheConfig, wrapper KeyWrapper) (*Cache, error) {
+	key, err := loadKey(cacheConfig, wrapper)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cache{
+		path:    cacheConfig.Path,
+		maxAge:  cacheConfig.TimeMaxAge,
+		aead:    aead,
+		entries: make(map[string]entry),
+	}
+
+	data, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading cache %v: %w", c.path, err)
+	}
+	if info, err := os.Stat(c.path); err == nil {
+		c.writtenAt = info.ModTime()
+	}
+	if err := c.decrypt(data); err != nil {
+		// A changed key or a damaged file only costs the cached values, which the next cycle replaces
+		log.Warnf("Ignoring cache %v: %v", c.path, err)
+	}
+	return c, nil
+}
+
+var (
+	// Nothing has been cached for the key
+	ErrNotCached = errors.New("not cached")
+	// The cached value is older than maxAge
+	ErrTooOld = errors.New("cached value is too old")
+)
+
+// Decodes the entry for key into value, if there is one younger than maxAge. It returns where the
+// value came from and when it was fetched
+func (c *Cache) Get(key string, value interface{}) (source string, fetchedAt time.Time, err error) {
+	c.mu.Lock()
+	cached, ok := c.entries[key]
+	c.mu.Unlock()
+
+	if !ok {
+		return "", time.Time{}, ErrNotCached
+	}
+	if time.Since(cached.FetchedAt) > c.maxAge {
+		return "", cached.FetchedAt, fmt.Errorf("%w: fetched at %v, maxAge is %v", ErrTooOld, cached.FetchedAt, c.maxAge)
+	}
+	if err := json.Unmarshal(cached.Value, value); err != nil {
+		return "", cached.FetchedAt, fmt.Errorf("decoding cached value: %w", err)
+	}
+	return cached.Source, cached.FetchedAt, nil
+}
+
+// Records the value just fetched for key. Fetching the same value again only refreshes its fetch time, which
+// doesn't need the file rewritten straight away
+func (c *Cache) Put(key string, value interface{}, source string) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous, ok := c.entries[key]
+	if !ok || previous.Source != source || !bytes.Equal(previous.Value, encoded) {
+		c.dirty = true
+	}
+	c.entries[key] = entry{Value: encoded, Source: source, FetchedAt: time.Now()}
+	return nil
+}
+
+// Drops entries older than maxAge, such as rotated secrets and resources no longer in the config, and writes the
+// rest to disk if a value changed or was dropped. Unchanged values are still written once the file is half maxAge
+// old, so values that are fetched again don't age out of it. The file is replaced rather than rewritten, so a crash
+// leaves the previous copy
+func (c *Cache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, cached := range c.entries {
+		if time.Since(cached.FetchedAt) > c.maxAge {
+			delete(c.entries, key)
+			c.dirty = true
+		}
+	}
+	if !c.dirty && (len(c.entries) == 0 || time.Since(c.writtenAt) < c.maxAge/2) {
+		return nil
+	}
+
+	plaintext, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data := append([]byte(header), nonce...)
+	data = c.aead.Seal(data, nonce, plaintext, []byte(header))
+
+	if err := replaceFile(c.path, data); err != nil {
+		return err
+	}
+
+	c.dirty = false
+	c.writtenAt = time.Now()
+	return nil
+}
+
+// Writes data to a temporary file readable only by the agent and renames it over path
+func replaceFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (c *Cache) decrypt(data []byte) error {
+	if !bytes.HasPrefix(data, []byte(header)) {
+		return errors.New("not a cache file")
+	}
+	data = data[len(header):]
+	if len(data) < c.aead.NonceSize() {
+		return errors.New("file is truncated")
+	}
+
+	plaintext, err := c.aead.Open(nil, data[:c.aead.NonceSize()], data[c.aead.NonceSize():], []byte(header))
+	if err != nil {
+		return errors.New("decryption failed, the key may have changed")
+	}
+	return json.Unmarshal(plaintext, &c.entries)
+}
@@ -0,0 +1,110 @@
+package diskcache
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/covermymeds/azure-key-vault-agent/config"
+)
+
+// Key material shorter than this is rejected, as the cache holds every secret the agent fetches
+const minKeyLength = 32
+
+// The cache key is kept in Key Vault and couldn't be wrapped or unwrapped, so the cache can't be used this time
+var ErrKeyUnavailable = errors.New("cache key unavailable")
+
+// Wraps and unwraps the cache's data key with a key held in a vault. The Key Vault client implements it
+type KeyWrapper interface {
+	WrapKey(ctx context.Context, vaultBaseURL string, keyName string, key []byte) (keyVersion string, wrapped []byte, err error)
+	UnwrapKey(ctx context.Context, vaultBaseURL string, keyName string, keyVersion string, wrapped []byte) ([]byte, error)
+}
+
+// A data key as kept next to the cache, wrapped by a Key Vault key
+type wrappedKey struct {
+	KeyVersion string `json:"keyVersion"`
+	WrappedKey []byte `json:"wrappedKey"`
+}
+
+// Reads the key material from the configured source and derives the AES-256 key from it
+func loadKey(cacheConfig config.CacheConfig, wrapper KeyWrapper) ([]byte, error) {
+	if cacheConfig.KeyvaultKey.Name != "" {
+		return loadWrappedKey(cacheConfig, wrapper)
+	}
+
+	path := cacheConfig.KeyFile
+	if cacheConfig.SystemdCredential != "" {
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return nil, fmt.Errorf("systemdCredential %v is set but CREDENTIALS_DIRECTORY is not, is LoadCredential= set for the unit?", cacheConfig.SystemdCredential)
+		}
+		path = filepath.Join(dir, cacheConfig.SystemdCredential)
+	}
+
+	material, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading cache key: %w", err)
+	}
+	if len(material) < minKeyLength {
+		return nil, fmt.Errorf("cache key %v is %v bytes, it must be at least %v", path, len(material), minKeyLength)
+	}
+
+	key := sha256.Sum256(material)
+	return key[:], nil
+}
+
+// Unwraps the data key kept in <path>.key, or creates and wraps a new one if there is none yet. Either needs the
+// vault holding keyvaultKey, so if it can't be reached the cache goes unused rather than replaced
+func loadWrappedKey(cacheConfig config.CacheConfig, wrapper KeyWrapper) ([]byte, error) {
+	keyConfig := cacheConfig.KeyvaultKey
+	if wrapper == nil {
+		return nil, fmt.Errorf("keyvaultKey credential %v can't wrap keys", keyConfig.Credential)
+	}
+	path := cacheConfig.Path + ".key"
+
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		var stored wrappedKey
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, fmt.Errorf("reading cache key %v: %w", path, err)
+		}
+		key, err := wrapper.UnwrapKey(context.Background(), keyConfig.VaultBaseURL, keyConfig.Name, stored.KeyVersion, stored.WrappedKey)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unwrapping %v with %v: %v", ErrKeyUnavailable, path, keyConfig.Name, err)
+		}
+		if len(key) != sha256.Size {
+			return nil, fmt.Errorf("cache key %v is %v bytes, want %v", path, len(key), sha256.Size)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading cache key: %w", err)
+	}
+
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	keyVersion, wrapped, err := wrapper.WrapKey(context.Background(), keyConfig.VaultBaseURL, keyConfig.Name, key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: wrapping a new key with %v: %v", ErrKeyUnavailable, keyConfig.Name, err)
+	}
+	data, err = json.Marshal(wrappedKey{KeyVersion: keyVersion, WrappedKey: wrapped})
+	if err != nil {
+		return nil, err
+	}
+	if err := replaceFile(path, data); err != nil {
+		return nil, fmt.Errorf("writing cache key %v: %w", path, err)
+	}
+
+	log.Printf("Created cache key %v, wrapped with %v version %v", path, keyConfig.Name, keyVersion)
+	return key, nil
+}
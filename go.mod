@@ -6,6 +6,7 @@ require (
 	github.com/Azure/azure-sdk-for-go v37.1.0+incompatible
 	github.com/Azure/go-autorest/autorest v0.9.3
 	github.com/Azure/go-autorest/autorest/adal v0.8.1
+	github.com/Azure/go-autorest/autorest/date v0.2.0
 	github.com/Masterminds/sprig v2.22.0+incompatible
 	github.com/cyberark/conjur-api-go v0.12.10
 	github.com/fsnotify/fsnotify v1.4.7
@@ -14,15 +15,15 @@ require (
 	github.com/jpillora/backoff v1.0.0
 	github.com/luci/luci-go v0.0.0-20200220034857-6a27eb3e318d
 	github.com/sirupsen/logrus v1.8.1
-	github.com/twmb/algoimpl v0.0.0-20170717182524-076353e90b94
-	golang.org/x/crypto v0.9.0
+	golang.org/x/crypto v0.31.0
+	golang.org/x/time v0.5.0
 	gopkg.in/yaml.v2 v2.4.0
+	software.sslmate.com/src/go-pkcs12 v0.4.0
 )
 
 require (
 	al.essio.dev/pkg/shellescape v1.5.1 // indirect
 	github.com/Azure/go-autorest v14.2.0+incompatible // indirect
-	github.com/Azure/go-autorest/autorest/date v0.2.0 // indirect
 	github.com/Azure/go-autorest/autorest/to v0.4.0 // indirect
 	github.com/Azure/go-autorest/autorest/validation v0.3.0 // indirect
 	github.com/Azure/go-autorest/logger v0.1.0 // indirect
@@ -46,5 +47,5 @@ require (
 	github.com/rogpeppe/go-internal v1.3.2 // indirect
 	github.com/smartystreets/goconvey v1.6.4 // indirect
 	github.com/zalando/go-keyring v0.2.6 // indirect
-	golang.org/x/sys v0.26.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
 )
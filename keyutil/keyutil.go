@@ -0,0 +1,277 @@
+package keyutil
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/covermymeds/azure-key-vault-agent/keys"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// The key has no JSON web key material
+	ErrNoKeyMaterial = errors.New("no key material found")
+	// The key is of a type other than RSA or EC, or the conversion does not support it
+	ErrUnsupportedKeyType = errors.New("unsupported key type")
+	// The key material could not be decoded or is not a valid public key
+	ErrInvalidKey = errors.New("invalid key material")
+)
+
+// A single public key as published in a JWKS document
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// Takes a Key Vault Key and produces PEM Encoded PKIX Public Key as String
+func PemPublicKeyFromKey(key keys.Key) (string, error) {
+	pub, err := PublicKeyFromKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("key %v: %w: %v", describeKey(key), ErrInvalidKey, err)
+	}
+
+	return pemEncode(key, "PUBLIC KEY", der)
+}
+
+// Takes a Key Vault RSA Key and produces PEM Encoded PKCS1 Public Key as String
+func PemPkcs1PublicKeyFromKey(key keys.Key) (string, error) {
+	pub, err := PublicKeyFromKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return "", fmt.Errorf("key %v: %w: PKCS1 public keys are only supported for RSA keys, got %v", describeKey(key), ErrUnsupportedKeyType, key.Key.Kty)
+	}
+
+	return pemEncode(key, "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(rsaPub))
+}
+
+// Takes a Key Vault Key and produces an OpenSSH authorized_keys line, using the key name as the comment
+func SshPublicKeyFromKey(key keys.Key) (string, error) {
+	pub, err := PublicKeyFromKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	sshKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("key %v: %w: %v", describeKey(key), ErrUnsupportedKeyType, err)
+	}
+
+	authorizedKey := strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(sshKey)), "\n")
+	if name := keyName(key); name != "" {
+		authorizedKey = authorizedKey + " " + name
+	}
+
+	return authorizedKey + "\n", nil
+}
+
+// Takes one or more Key Vault Keys and produces a JSON Web Key Set as String
+func JwksFromKeys(items []keys.Key) (string, error) {
+	set := jsonWebKeySet{Keys: []jsonWebKey{}}
+
+	// The same key may be present under both its name and an alias
+	seen := make(map[string]bool)
+	for _, key := range items {
+		jwk, err := publicJsonWebKey(key)
+		if err != nil {
+			return "", err
+		}
+		if jwk.Kid != "" && seen[jwk.Kid] {
+			continue
+		}
+		seen[jwk.Kid] = true
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	// Keep the output stable between runs so sinks only change when the keys do
+	sort.SliceStable(set.Keys, func(i, j int) bool {
+		return set.Keys[i].Kid < set.Keys[j].Kid
+	})
+
+	data, err := json.Marshal(set)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode key set: %w", err)
+	}
+
+	return string(data), nil
+}
+
+// Converts the JSON Web Key held by a Key Vault Key into a crypto.PublicKey, naming the key in any error
+func PublicKeyFromKey(key keys.Key) (crypto.PublicKey, error) {
+	pub, err := publicKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("key %v: %w", describeKey(key), err)
+	}
+
+	return pub, nil
+}
+
+func publicKey(key keys.Key) (crypto.PublicKey, error) {
+	if key.Key == nil {
+		return nil, ErrNoKeyMaterial
+	}
+	jwk := key.Key
+
+	switch jwk.Kty {
+	case keyvault.RSA, keyvault.RSAHSM:
+		n, err := decodeBigInt("n", jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt("e", jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > int64(^uint32(0)>>1) {
+			return nil, fmt.Errorf("%w: RSA public exponent is too large", ErrInvalidKey)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case keyvault.EC, keyvault.ECHSM:
+		curve, err := curveFromName(jwk.Crv)
+		if err != nil {
+			return nil, err
+		}
+		x, err := decodeBigInt("x", jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt("y", jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("%w: EC public key is not on curve %v", ErrInvalidKey, jwk.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedKeyType, jwk.Kty)
+	}
+}
+
+// Builds the public half of a JWK, dropping any private or HSM-specific material
+func publicJsonWebKey(key keys.Key) (jsonWebKey, error) {
+	// Validate the key material before publishing it
+	if _, err := PublicKeyFromKey(key); err != nil {
+		return jsonWebKey{}, err
+	}
+
+	jwk := key.Key
+	result := jsonWebKey{}
+	if jwk.Kid != nil {
+		result.Kid = *jwk.Kid
+	}
+
+	switch jwk.Kty {
+	case keyvault.RSA, keyvault.RSAHSM:
+		result.Kty = string(keyvault.RSA)
+		result.N = *jwk.N
+		result.E = *jwk.E
+	case keyvault.EC, keyvault.ECHSM:
+		result.Kty = string(keyvault.EC)
+		result.Crv = string(jwk.Crv)
+		result.X = *jwk.X
+		result.Y = *jwk.Y
+	}
+
+	return result, nil
+}
+
+// Extracts the key name from a Key Vault key identifier like https://vault/keys/<name>/<version>
+func keyName(key keys.Key) string {
+	if key.Key == nil || key.Key.Kid == nil {
+		return ""
+	}
+
+	u, err := url.Parse(*key.Key.Kid)
+	if err != nil {
+		return ""
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "keys" {
+		return ""
+	}
+
+	return parts[1]
+}
+
+// Names the key in errors, falling back to its full ID when that isn't a Key Vault key identifier
+func describeKey(key keys.Key) string {
+	if name := keyName(key); name != "" {
+		return name
+	}
+	if key.Key != nil && key.Key.Kid != nil {
+		return *key.Key.Kid
+	}
+
+	return "(unnamed)"
+}
+
+func curveFromName(name keyvault.JSONWebKeyCurveName) (elliptic.Curve, error) {
+	switch name {
+	case keyvault.P256:
+		return elliptic.P256(), nil
+	case keyvault.P384:
+		return elliptic.P384(), nil
+	case keyvault.P521:
+		return elliptic.P521(), nil
+	default:
+		return nil, fmt.Errorf("%w: curve %v", ErrUnsupportedKeyType, name)
+	}
+}
+
+// JWK values are unpadded base64url, but be lenient about padding
+func decodeBigInt(field string, value *string) (*big.Int, error) {
+	if value == nil {
+		return nil, fmt.Errorf("%w: missing the %v component", ErrInvalidKey, field)
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(*value, "="))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode %v component: %v", ErrInvalidKey, field, err)
+	}
+
+	return new(big.Int).SetBytes(data), nil
+}
+
+func pemEncode(key keys.Key, blockType string, der []byte) (string, error) {
+	var buffer bytes.Buffer
+	if err := pem.Encode(&buffer, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		return "", fmt.Errorf("key %v: failed to write data: %w", describeKey(key), err)
+	}
+
+	return buffer.String(), nil
+}
@@ -14,4 +14,26 @@ type ResourceMap struct {
 	Certs   map[string]certs.Cert
 	Secrets map[string]secrets.Secret
 	Keys    map[string]keys.Key
+	// The latest versions of secret-versions resources, newest first
+	SecretVersions map[string][]secrets.Secret
+	// Names of the resources above that are the last value fetched, because fetching them again failed
+	Stale StaleMap
+	// The vault or safe each of the resources above was fetched from
+	Sources SourceMap
+}
+
+// Stale resources by kind, as a cert and the secret backing it share a name
+type StaleMap struct {
+	Certs          map[string]bool
+	Secrets        map[string]bool
+	Keys           map[string]bool
+	SecretVersions map[string]bool
+}
+
+// The source of each resource by kind, as a cert and the secret backing it share a name
+type SourceMap struct {
+	Certs          map[string]string
+	Secrets        map[string]string
+	Keys           map[string]string
+	SecretVersions map[string]string
 }
@@ -1,8 +1,28 @@
 package secrets
 
+import "time"
+
 type Secret struct {
-	Value *string
+	Name        string
+	Value       *string
 	ContentType *string
+
+	// Password for PKCS12 values, from the resource's pfxPasswordSecret
+	PfxPassword string
+
+	// Metadata from the vault. Cyberark only provides the version, and any field may be unset
+	Version   string
+	Tags      map[string]string
+	Enabled   *bool
+	NotBefore *time.Time
+	Expires   *time.Time
+	Created   *time.Time
+	Updated   *time.Time
+
+	// The vault or safe the secret was fetched from, which differs from the resource's when a fallback served it
+	Source string
+	// Set when the vault couldn't be reached and the last value fetched is used instead
+	Stale bool
 }
 
 func (s Secret) String() string {
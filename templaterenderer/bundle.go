@@ -0,0 +1,68 @@
+package templaterenderer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/covermymeds/azure-key-vault-agent/certutil"
+	"github.com/covermymeds/azure-key-vault-agent/secrets"
+)
+
+// A PEM section of a bundle
+type bundlePart int
+
+const (
+	bundleKey bundlePart = iota
+	bundleCert
+	bundleIssuers
+)
+
+// The leaf followed by its issuers
+var certAndIssuers = []bundlePart{bundleCert, bundleIssuers}
+
+// The order of the sections written by the bundle helper for each layout. Layouts are named after what
+// reads them, so nginx and cert+chain are the same layout under the names their users look for
+var bundleLayouts = map[string][]bundlePart{
+	// crt files with the certificate, its issuers and the key in one file
+	"haproxy": {bundleCert, bundleIssuers, bundleKey},
+	// ssl_certificate, with the key in its own file
+	"nginx": certAndIssuers,
+	// For tools that read the key first
+	"key+cert": {bundleKey, bundleCert},
+	// e.g. Envoy's certificate_chain
+	"cert+chain": certAndIssuers,
+}
+
+// Concatenates the key, leaf and sorted issuers of a secret in the order of the named layout
+func bundleFromSecret(secret secrets.Secret, layout string, completer *certutil.ChainCompleter) (string, error) {
+	parts, ok := bundleLayouts[layout]
+	if !ok {
+		var names []string
+		for name := range bundleLayouts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("unknown bundle layout %q, expected one of %v", layout, strings.Join(names, ", "))
+	}
+
+	var b strings.Builder
+	for _, part := range parts {
+		var pem string
+		var err error
+		switch part {
+		case bundleKey:
+			pem, err = privateKeyFromSecret(secret)
+		case bundleCert:
+			pem, err = certFromSecret(secret)
+		case bundleIssuers:
+			pem, err = chainFromSecret(secret, true, completer)
+		}
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(pem)
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,102 @@
+package templaterenderer
+
+import (
+	"fmt"
+	"sort"
+	"text/template"
+
+	"github.com/covermymeds/azure-key-vault-agent/config"
+	"github.com/covermymeds/azure-key-vault-agent/secrets"
+)
+
+// A secret requested by a template function rather than declared under resources
+type Dependency struct {
+	Kind    config.ResourceKind
+	Vault   string
+	Name    string
+	Version string
+}
+
+func (d Dependency) String() string {
+	if d.Version != "" {
+		return fmt.Sprintf("%v %v/%v (version %v)", d.Kind, d.Vault, d.Name, d.Version)
+	}
+	return fmt.Sprintf("%v %v/%v", d.Kind, d.Vault, d.Name)
+}
+
+// Holds the secrets fetched on behalf of kvSecret and conjurSecret for one worker cycle.
+// During a dry run, every secret looked up is recorded in Requested, and secrets that have not
+// been fetched yet are also recorded in Missing and rendered as empty values so the rest of the
+// template can still be walked.
+type DynamicSecrets struct {
+	Values    map[Dependency]secrets.Secret
+	Missing   map[Dependency]bool
+	Requested map[Dependency]bool
+	DryRun    bool
+}
+
+func NewDynamicSecrets() *DynamicSecrets {
+	return &DynamicSecrets{
+		Values:    make(map[Dependency]secrets.Secret),
+		Missing:   make(map[Dependency]bool),
+		Requested: make(map[Dependency]bool),
+	}
+}
+
+// The missing dependencies in a stable order
+func (d *DynamicSecrets) MissingDependencies() []Dependency {
+	var missing []Dependency
+	for dependency := range d.Missing {
+		missing = append(missing, dependency)
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i].String() < missing[j].String()
+	})
+	return missing
+}
+
+func (d *DynamicSecrets) lookup(kind config.ResourceKind, vault string, name string, version ...string) (secrets.Secret, error) {
+	if d == nil {
+		return secrets.Secret{}, fmt.Errorf("template requested %v %v/%v, but dynamicResources is not enabled for this worker", kind, vault, name)
+	}
+	if len(version) > 1 {
+		return secrets.Secret{}, fmt.Errorf("template requested %v %v/%v with more than one version", kind, vault, name)
+	}
+
+	dependency := Dependency{Kind: kind, Vault: vault, Name: name}
+	if len(version) == 1 {
+		dependency.Version = version[0]
+	}
+
+	// An empty vault or name usually comes from a secret that hasn't been fetched yet, so wait for the next render
+	complete := vault != "" && name != ""
+	if d.DryRun && complete {
+		d.Requested[dependency] = true
+	}
+
+	if secret, ok := d.Values[dependency]; ok {
+		return secret, nil
+	}
+
+	if !d.DryRun {
+		return secrets.Secret{}, fmt.Errorf("template requested %v, which was not fetched", dependency)
+	}
+
+	if complete {
+		d.Missing[dependency] = true
+	}
+
+	empty := ""
+	return secrets.Secret{Value: &empty, ContentType: &empty}, nil
+}
+
+func (d *DynamicSecrets) funcs() template.FuncMap {
+	return template.FuncMap{
+		"kvSecret": func(vaultBaseURL string, name string, version ...string) (secrets.Secret, error) {
+			return d.lookup(config.SecretKind, vaultBaseURL, name, version...)
+		},
+		"conjurSecret": func(safeName string, name string, version ...string) (secrets.Secret, error) {
+			return d.lookup(config.CyberarkSecretKind, safeName, name, version...)
+		},
+	}
+}
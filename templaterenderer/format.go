@@ -0,0 +1,283 @@
+package templaterenderer
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/covermymeds/azure-key-vault-agent/config"
+	"github.com/covermymeds/azure-key-vault-agent/resource"
+	"github.com/covermymeds/azure-key-vault-agent/secrets"
+	"gopkg.in/yaml.v2"
+)
+
+var dotenvKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+var tomlBareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Serializes the worker's secrets in the sink's configured format instead of rendering a template
+func RenderFormat(sinkConfig config.SinkConfig, resourceMap resource.ResourceMap) (string, error) {
+	values, err := renameKeys(sinkConfig, filterSecrets(sinkConfig, ToValues(resourceMap.Secrets)))
+	if err != nil {
+		return "", err
+	}
+
+	switch sinkConfig.Format {
+	case config.JsonFormat:
+		return formatJson(values)
+	case config.YamlFormat:
+		return formatYaml(values)
+	case config.DotenvFormat:
+		return formatDotenv(values)
+	case config.PropertiesFormat:
+		return formatProperties(values), nil
+	case config.TomlFormat:
+		return formatToml(values), nil
+	case config.IniFormat:
+		return formatIni(values)
+	default:
+		return "", fmt.Errorf("got unexpected format: %v", sinkConfig.Format)
+	}
+}
+
+// Returns the value of each secret keyed by name
+func ToValues(items map[string]secrets.Secret) map[string]string {
+	secretValues := make(map[string]string)
+	for key, secret := range items {
+		secretValues[key] = *secret.Value
+	}
+	return secretValues
+}
+
+// Keeps the secrets listed in names or starting with prefix. With neither set everything is kept
+func filterSecrets(sinkConfig config.SinkConfig, values map[string]string) map[string]string {
+	if len(sinkConfig.Names) == 0 && sinkConfig.Prefix == "" {
+		return values
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range sinkConfig.Names {
+		wanted[name] = true
+	}
+
+	results := make(map[string]string)
+	for name, value := range values {
+		if wanted[name] || (sinkConfig.Prefix != "" && strings.HasPrefix(name, sinkConfig.Prefix)) {
+			results[name] = value
+		}
+	}
+
+	return results
+}
+
+// Applies the sink's key rules. An explicit rename wins, otherwise the prefix is stripped, replacements applied, then case changed
+func renameKeys(sinkConfig config.SinkConfig, values map[string]string) (map[string]string, error) {
+	rules := sinkConfig.Keys
+
+	var replacements []string
+	for from, to := range rules.Replace {
+		replacements = append(replacements, from, to)
+	}
+	// Longest match first, so overlapping rules behave the same every run
+	sort.Sort(byLengthDesc(replacements))
+	replacer := strings.NewReplacer(replacements...)
+
+	results := make(map[string]string)
+	origins := make(map[string]string)
+	for name, value := range values {
+		key, ok := rules.Rename[name]
+		if !ok {
+			key = name
+			if rules.StripPrefix {
+				key = strings.TrimPrefix(key, sinkConfig.Prefix)
+			}
+			key = replacer.Replace(key)
+			switch rules.Case {
+			case "upper":
+				key = strings.ToUpper(key)
+			case "lower":
+				key = strings.ToLower(key)
+			}
+		}
+
+		if key == "" {
+			return nil, fmt.Errorf("error rendering %v: secret %v has an empty key after renaming", sinkConfig.Path, name)
+		}
+		if other, ok := origins[key]; ok {
+			return nil, fmt.Errorf("error rendering %v: secrets %v and %v are both renamed to %v", sinkConfig.Path, other, name, key)
+		}
+		origins[key] = name
+		results[key] = value
+	}
+
+	return results, nil
+}
+
+// Sorts pairs of replacement strings so the longest "from" comes first
+type byLengthDesc []string
+
+func (p byLengthDesc) Len() int { return len(p) / 2 }
+func (p byLengthDesc) Less(i, j int) bool {
+	if len(p[i*2]) != len(p[j*2]) {
+		return len(p[i*2]) > len(p[j*2])
+	}
+	return p[i*2] < p[j*2]
+}
+func (p byLengthDesc) Swap(i, j int) {
+	p[i*2], p[j*2] = p[j*2], p[i*2]
+	p[i*2+1], p[j*2+1] = p[j*2+1], p[i*2+1]
+}
+
+func sortedKeys(values map[string]string) []string {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatJson(values map[string]string) (string, error) {
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("error rendering json: %w", err)
+	}
+	return string(data) + "\n", nil
+}
+
+func formatYaml(values map[string]string) (string, error) {
+	if len(values) == 0 {
+		return "{}\n", nil
+	}
+	data, err := yaml.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("error rendering yaml: %w", err)
+	}
+	return string(data), nil
+}
+
+// KEY="value" with the escapes understood by docker compose and the common dotenv libraries. systemd reads the
+// quoting too, but not \n, so it gets multi-line values with literal \n in place of the newlines
+func formatDotenv(values map[string]string) (string, error) {
+	var b strings.Builder
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`", "\n", `\n`, "\r", `\r`)
+	for _, key := range sortedKeys(values) {
+		if !dotenvKey.MatchString(key) {
+			return "", fmt.Errorf("error rendering dotenv: %q is not a valid variable name, use the keys options to rename it", key)
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"\n", key, escaper.Replace(values[key]))
+	}
+	return b.String(), nil
+}
+
+// key=value following the java.util.Properties escaping rules, with non-ASCII written as \uXXXX
+func formatProperties(values map[string]string) string {
+	var b strings.Builder
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(&b, "%s=%s\n", escapeProperty(key, true), escapeProperty(values[key], false))
+	}
+	return b.String()
+}
+
+func escapeProperty(s string, isKey bool) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\f':
+			b.WriteString(`\f`)
+		case r == '=' || r == ':' || r == '#' || r == '!':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == ' ' && (isKey || i == 0):
+			// Spaces separate keys from values, and leading spaces of values are trimmed by the parser
+			b.WriteString(`\ `)
+		case r < 0x20 || r > 0x7e:
+			for _, unit := range utf16Units(r) {
+				fmt.Fprintf(&b, `\u%04X`, unit)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func utf16Units(r rune) []uint16 {
+	if r < 0x10000 {
+		return []uint16{uint16(r)}
+	}
+	r -= 0x10000
+	return []uint16{uint16(0xd800 + (r >> 10)), uint16(0xdc00 + (r & 0x3ff))}
+}
+
+func formatToml(values map[string]string) string {
+	var b strings.Builder
+	for _, key := range sortedKeys(values) {
+		tomlKey := key
+		if !tomlBareKey.MatchString(key) {
+			tomlKey = tomlString(key)
+		}
+		fmt.Fprintf(&b, "%s = %s\n", tomlKey, tomlString(values[key]))
+	}
+	return b.String()
+}
+
+// A TOML basic string
+func tomlString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// INI has no escaping standard, so refuse anything a parser could misread rather than guess
+func formatIni(values map[string]string) (string, error) {
+	var b strings.Builder
+	for _, key := range sortedKeys(values) {
+		if key != strings.TrimSpace(key) || strings.ContainsAny(key, "=:;#[]\r\n") {
+			return "", fmt.Errorf("error rendering ini: %q is not a valid key, use the keys options to rename it", key)
+		}
+		if strings.ContainsAny(values[key], "\r\n") {
+			return "", fmt.Errorf("error rendering ini: the value of %q contains a newline, which ini files cannot represent", key)
+		}
+		// Some parsers strip inline comments and surrounding whitespace from values, others keep them
+		if values[key] != strings.TrimSpace(values[key]) || strings.ContainsAny(values[key], ";#") {
+			return "", fmt.Errorf("error rendering ini: the value of %q has surrounding whitespace or a ; or #, which ini parsers read differently", key)
+		}
+		fmt.Fprintf(&b, "%s = %s\n", key, values[key])
+	}
+	return b.String(), nil
+}
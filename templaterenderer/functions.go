@@ -0,0 +1,137 @@
+package templaterenderer
+
+import (
+	"fmt"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/Masterminds/sprig"
+	"github.com/covermymeds/azure-key-vault-agent/certutil"
+	"github.com/covermymeds/azure-key-vault-agent/config"
+)
+
+// Functions removed by the default hardened profile, since they expose the agent's own credentials
+var hardenedDeny = []string{"env", "expandenv"}
+
+// Works out which template functions the policy blocks. Agent helpers are always allowed unless denied
+func BlockedFunctions(policy config.TemplateFunctionsConfig) map[string]bool {
+	known := allFuncs()
+	blocked := make(map[string]bool)
+
+	for _, name := range append(append([]string{}, policy.Allow...), policy.Deny...) {
+		if _, ok := known[name]; !ok {
+			panic(fmt.Sprintf("Error parsing templateFunctions: unknown function %v", name))
+		}
+	}
+
+	if len(policy.Allow) > 0 {
+		// An allowlist replaces the profile: only the listed sprig functions are available
+		allowed := make(map[string]bool)
+		for _, name := range policy.Allow {
+			allowed[name] = true
+		}
+		for name := range sprig.TxtFuncMap() {
+			if _, isHelper := helpers(nil, "")[name]; !allowed[name] && !isHelper {
+				blocked[name] = true
+			}
+		}
+	} else if policy.Profile != "permissive" {
+		for _, name := range hardenedDeny {
+			blocked[name] = true
+		}
+	}
+
+	for _, name := range policy.Deny {
+		blocked[name] = true
+	}
+
+	return blocked
+}
+
+// Every function a template could use, before any policy is applied
+func allFuncs() template.FuncMap {
+	funcs := helpers(nil, "")
+	for name, fn := range sprig.TxtFuncMap() {
+		funcs[name] = fn
+	}
+	var dynamic *DynamicSecrets
+	for name, fn := range dynamic.funcs() {
+		funcs[name] = fn
+	}
+	return funcs
+}
+
+// The functions available to templates under the given policy. sinkPath is the file being rendered, if any
+func funcMap(blocked map[string]bool, completer *certutil.ChainCompleter, dynamic *DynamicSecrets, sinkPath string) template.FuncMap {
+	funcs := allFuncs()
+	for name, fn := range helpers(completer, sinkPath) {
+		funcs[name] = fn
+	}
+	for name, fn := range dynamic.funcs() {
+		funcs[name] = fn
+	}
+	for name := range blocked {
+		delete(funcs, name)
+	}
+	return funcs
+}
+
+// Returns an error naming the first blocked function called by any template in t
+func checkBlockedFunctions(t *template.Template, blocked map[string]bool) error {
+	for _, defined := range t.Templates() {
+		if defined.Tree == nil {
+			continue
+		}
+		if name := findBlockedFunction(defined.Tree.Root, blocked); name != "" {
+			return fmt.Errorf("function %q is blocked by the templateFunctions policy", name)
+		}
+	}
+	return nil
+}
+
+func findBlockedFunction(node parse.Node, blocked map[string]bool) string {
+	var children []parse.Node
+
+	switch n := node.(type) {
+	case nil:
+		return ""
+	case *parse.IdentifierNode:
+		if blocked[n.Ident] {
+			return n.Ident
+		}
+	case *parse.ListNode:
+		if n != nil {
+			for _, child := range n.Nodes {
+				children = append(children, child)
+			}
+		}
+	case *parse.ActionNode:
+		children = append(children, n.Pipe)
+	case *parse.PipeNode:
+		if n != nil {
+			for _, cmd := range n.Cmds {
+				children = append(children, cmd)
+			}
+		}
+	case *parse.CommandNode:
+		children = append(children, n.Args...)
+	case *parse.ChainNode:
+		children = append(children, n.Node)
+	case *parse.IfNode:
+		children = append(children, n.Pipe, n.List, n.ElseList)
+	case *parse.RangeNode:
+		children = append(children, n.Pipe, n.List, n.ElseList)
+	case *parse.WithNode:
+		children = append(children, n.Pipe, n.List, n.ElseList)
+	case *parse.TemplateNode:
+		children = append(children, n.Pipe)
+	}
+
+	for _, child := range children {
+		if name := findBlockedFunction(child, blocked); name != "" {
+			return name
+		}
+	}
+
+	return ""
+}
@@ -2,126 +2,388 @@ package templaterenderer
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"text/template"
 
-	"github.com/Masterminds/sprig"
 	"github.com/covermymeds/azure-key-vault-agent/certs"
 	"github.com/covermymeds/azure-key-vault-agent/certutil"
+	"github.com/covermymeds/azure-key-vault-agent/config"
+	"github.com/covermymeds/azure-key-vault-agent/keys"
+	"github.com/covermymeds/azure-key-vault-agent/keyutil"
 	"github.com/covermymeds/azure-key-vault-agent/resource"
 	"github.com/covermymeds/azure-key-vault-agent/secrets"
 )
 
-func RenderFile(path string, resourceMap resource.ResourceMap) string {
+// The name given to the sink's own template, which library templates may not reuse
+const rootTemplateName = "template"
+
+func RenderFile(path string, sinkConfig config.SinkConfig, resourceMap resource.ResourceMap, dynamic *DynamicSecrets) (string, error) {
 	contents, err := ioutil.ReadFile(path)
 
 	if err != nil {
-		panic(fmt.Sprintf("Error reading template %v: %v", path, err))
+		return "", fmt.Errorf("error reading template %v: %w", path, err)
 	}
 
-	return RenderInline(string(contents), resourceMap)
+	return RenderInline(string(contents), sinkConfig, resourceMap, dynamic)
 }
 
-func RenderInline(templateContents string, resourceMap resource.ResourceMap) string {
-	helpers := template.FuncMap{
-		"privateKey": func(secret secrets.Secret) string {
-			switch contentType := *secret.ContentType; contentType {
-			case "application/x-pem-file":
-				return certutil.PemPrivateKeyFromPem(*secret.Value)
-			case "application/x-pkcs12":
-				return certutil.PemPrivateKeyFromPkcs12(*secret.Value)
-			default:
-				panic(fmt.Sprintf("Got unexpected content type: %v", contentType))
+// Renders a sink template. dynamic holds the secrets for kvSecret and conjurSecret, and is nil unless the worker enables dynamicResources.
+// Errors from the template and its helpers are returned, so they only fail the worker's current cycle
+func RenderInline(templateContents string, sinkConfig config.SinkConfig, resourceMap resource.ResourceMap, dynamic *DynamicSecrets) (string, error) {
+	// Init the template
+	t := template.New(rootTemplateName).Funcs(funcMap(sinkConfig.BlockedFunctions, chainCompleter(sinkConfig.ChainCompletion), dynamic, sinkConfig.Path))
+
+	// Add the shared template library, and make sure the sink doesn't redefine any of it
+	library, err := parsePartials(t, sinkConfig.Partials, sinkConfig.BlockedFunctions)
+	if err != nil {
+		return "", err
+	}
+
+	// Parse with every function known so a blocked one gets a clearer error than "not defined"
+	own, err := template.New(rootTemplateName).Funcs(allFuncs()).Parse(templateContents)
+	if err == nil {
+		err = checkBlockedFunctions(own, sinkConfig.BlockedFunctions)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error parsing template:\n%v\nError:\n%w", templateContents, err)
+	}
+	for _, defined := range own.Templates() {
+		if path, ok := library[defined.Name()]; ok {
+			return "", fmt.Errorf("error parsing template: %q is already defined in template library %v", defined.Name(), path)
+		}
+	}
+
+	t, err = t.Parse(templateContents)
+	if err != nil {
+		return "", fmt.Errorf("error parsing template:\n%v\nError:\n%w", templateContents, err)
+	}
+
+	// Execute the template. Helpers that panic are turned into errors by text/template
+	var buf bytes.Buffer
+	err = t.Execute(&buf, resourceMap)
+	if err != nil {
+		return "", fmt.Errorf("error executing template: %v Error: %w", templateContents, err)
+	}
+
+	return buf.String(), nil
+}
+
+// Reads every *.tmpl file in the given directories so they can be shared by all sinks
+func LoadPartials(dirs []string, blocked map[string]bool) map[string]string {
+	partials := make(map[string]string)
+
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil {
+			panic(fmt.Sprintf("Error reading template directory %v: %v", dir, err))
+		}
+		if !info.IsDir() {
+			panic(fmt.Sprintf("Error reading template directory %v: not a directory", dir))
+		}
+
+		paths, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+		if err != nil {
+			panic(fmt.Sprintf("Error reading template directory %v: %v", dir, err))
+		}
+
+		for _, path := range paths {
+			contents, err := ioutil.ReadFile(path)
+			if err != nil {
+				panic(fmt.Sprintf("Error reading template %v: %v", path, err))
 			}
+			partials[path] = string(contents)
+		}
+	}
+
+	// Parse everything up front so syntax errors and name collisions are reported at config load
+	if _, err := parsePartials(template.New(rootTemplateName).Funcs(funcMap(blocked, nil, nil, "")), partials, blocked); err != nil {
+		panic(fmt.Sprintf("Error loading templateDirs: %v", err))
+	}
+
+	return partials
+}
+
+// Adds the named templates from each library file to t, returning the file each name was defined in
+func parsePartials(t *template.Template, partials map[string]string, blocked map[string]bool) (map[string]string, error) {
+	var paths []string
+	for path := range partials {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	library := make(map[string]string)
+	for _, path := range paths {
+		parsed, err := template.New(path).Funcs(allFuncs()).Parse(partials[path])
+		if err == nil {
+			err = checkBlockedFunctions(parsed, blocked)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing template library %v: %v", path, err)
+		}
+
+		for _, defined := range parsed.Templates() {
+			name := defined.Name()
+			// The file itself is only a container for its define blocks
+			if name == path {
+				continue
+			}
+			if name == rootTemplateName {
+				return nil, fmt.Errorf("error parsing template library %v: %q is a reserved template name", path, name)
+			}
+			if other, ok := library[name]; ok {
+				return nil, fmt.Errorf("error parsing template library %v: %q is already defined in %v", path, name, other)
+			}
+			library[name] = path
+
+			if _, err := t.AddParseTree(name, defined.Tree); err != nil {
+				return nil, fmt.Errorf("error parsing template library %v: %v", path, err)
+			}
+		}
+	}
+
+	return library, nil
+}
+
+// The agent's own template helpers. completer adds missing issuers to chains, and may be nil. sinkPath is the
+// file being rendered, which encryptedPrivateKey reuses an unchanged key from
+func helpers(completer *certutil.ChainCompleter, sinkPath string) template.FuncMap {
+	return template.FuncMap{
+		"privateKey": privateKeyFromSecret,
+		"privateKeyWithPassword": func(secret secrets.Secret, password string) (string, error) {
+			return privateKeyFromSecret(withPfxPassword(secret, password))
+		},
+		"privateKeyAs": func(format string, secret secrets.Secret) (string, error) {
+			return formattedPrivateKeyFromSecret(secret, format, "")
 		},
-		"cert": func(resource resource.Resource) string {
+		"encryptedPrivateKey": func(passphrase string, secret secrets.Secret) (string, error) {
+			if passphrase == "" {
+				return "", fmt.Errorf("secret %v: encryptedPrivateKey needs a passphrase", secret.Name)
+			}
+			return encryptedPrivateKeyFromSecret(secret, passphrase, sinkPath)
+		},
+		"cert": func(resource resource.Resource) (string, error) {
 			switch t := resource.(type) {
 			case certs.Cert:
 				cert := resource.(certs.Cert)
-				return certutil.PemCertFromBytes(*cert.Cer)
+				if cert.Cer == nil {
+					return "", fmt.Errorf("cert %v: %w", certName(cert), certutil.ErrNoCertificate)
+				}
+				result, err := certutil.PemCertFromBytes(*cert.Cer)
+				if err != nil {
+					return "", fmt.Errorf("cert %v: %w", certName(cert), err)
+				}
+				return result, nil
 			case secrets.Secret:
 				return certFromSecret(resource.(secrets.Secret))
 			default:
-				panic(fmt.Sprintf("Got unexpected type: %v", t))
+				return "", fmt.Errorf("got unexpected type: %v", t)
 			}
 		},
-		"issuers": func(secret secrets.Secret) string {
-			switch contentType := *secret.ContentType; contentType {
-			case "application/x-pem-file":
-				return certutil.PemChainFromPem(*secret.Value, true)
-			case "application/x-pkcs12":
-				return certutil.PemChainFromPkcs12(*secret.Value, true)
-			default:
-				panic(fmt.Sprintf("Got unexpected content type: %v", contentType))
-			}
+		"certWithPassword": func(secret secrets.Secret, password string) (string, error) {
+			return certFromSecret(withPfxPassword(secret, password))
 		},
-		"expandFullChain": func(items map[string]secrets.Secret) map[string]secrets.Secret {
+		"issuers": func(secret secrets.Secret) (string, error) {
+			return chainFromSecret(secret, true, completer)
+		},
+		"issuersWithPassword": func(secret secrets.Secret, password string) (string, error) {
+			return chainFromSecret(withPfxPassword(secret, password), true, completer)
+		},
+		"expandFullChain": func(items map[string]secrets.Secret) (map[string]secrets.Secret, error) {
 			results := make(map[string]secrets.Secret)
 
 			for secretName, secret := range items {
 				results[secretName] = secret
 				if secret.ContentType != nil {
 					switch contentType := *secret.ContentType; contentType {
-					case "application/x-pem-file":
-						results[secretName+".key"] = cloneSecret(secret, certutil.PemPrivateKeyFromPem(*secret.Value))
-						results[secretName+".pem"] = cloneSecret(secret, certutil.PemChainFromPem(*secret.Value, false))
-					case "application/x-pkcs12":
-						results[secretName+".key"] = cloneSecret(secret, certutil.PemPrivateKeyFromPkcs12(*secret.Value))
-						results[secretName+".pem"] = cloneSecret(secret, certutil.PemChainFromPkcs12(*secret.Value, false))
+					case "application/x-pem-file", "application/x-pkcs12":
+						// A secret missing its key or certificates still gets an (empty) entry for it
+						key, err := privateKeyFromSecret(secret)
+						if err != nil && !errors.Is(err, certutil.ErrNoPrivateKey) {
+							return nil, err
+						}
+						chain, err := chainFromSecret(secret, false, completer)
+						if err != nil && !errors.Is(err, certutil.ErrNoCertificate) {
+							return nil, err
+						}
+						results[secretName+".key"] = cloneSecret(secret, key)
+						results[secretName+".pem"] = cloneSecret(secret, chain)
 					default:
 						continue
 					}
 				}
 			}
-			return results
+			return results, nil
 		},
-		"fullChain": func(secret secrets.Secret) string {
-			switch contentType := *secret.ContentType; contentType {
-			case "application/x-pem-file":
-				return certutil.PemChainFromPem(*secret.Value, false)
-			case "application/x-pkcs12":
-				return certutil.PemChainFromPkcs12(*secret.Value, false)
-			default:
-				panic(fmt.Sprintf("Got unexpected content type: %v", contentType))
-			}
+		"fullChain": func(secret secrets.Secret) (string, error) {
+			return chainFromSecret(secret, false, completer)
+		},
+		"fullChainWithPassword": func(secret secrets.Secret, password string) (string, error) {
+			return chainFromSecret(withPfxPassword(secret, password), false, completer)
+		},
+		"bundle": func(layout string, secret secrets.Secret) (string, error) {
+			return bundleFromSecret(secret, layout, completer)
+		},
+		"trustBundle": func(items ...interface{}) (string, error) {
+			return trustBundle(false, items...)
 		},
-		"toValues": func(secrets map[string]secrets.Secret) map[string]string {
-			secretValues := make(map[string]string)
-			for key, secret := range secrets {
-				secretValues[key] = *secret.Value
+		"unexpiredTrustBundle": func(items ...interface{}) (string, error) {
+			return trustBundle(true, items...)
+		},
+		"toValues":     ToValues,
+		"publicKey":    keyutil.PemPublicKeyFromKey,
+		"rsaPublicKey": keyutil.PemPkcs1PublicKeyFromKey,
+		"sshPublicKey": keyutil.SshPublicKeyFromKey,
+		"jwks": func(items ...interface{}) (string, error) {
+			var results []keys.Key
+			for _, item := range items {
+				switch t := item.(type) {
+				case keys.Key:
+					results = append(results, t)
+				case map[string]keys.Key:
+					for _, key := range t {
+						results = append(results, key)
+					}
+				default:
+					return "", fmt.Errorf("jwks: got unexpected type: %T", item)
+				}
 			}
-			return secretValues
+			return keyutil.JwksFromKeys(results)
 		},
 	}
+}
 
-	// Init the template
-	t, err := template.New("template").Funcs(helpers).Funcs(sprig.TxtFuncMap()).Parse(templateContents)
+func privateKeyFromSecret(secret secrets.Secret) (string, error) {
+	return fromSecret(secret, certutil.PemPrivateKeyFromPem, certutil.PemPrivateKeyFromPkcs12)
+}
+
+// Extracts the private key and re-encodes it, e.g. as PKCS#1 or OpenSSH, naming the secret in any error
+func formattedPrivateKeyFromSecret(secret secrets.Secret, format string, passphrase string) (string, error) {
+	key, err := privateKeyFromSecret(secret)
 	if err != nil {
-		panic(fmt.Sprintf("Error parsing template:\n%v\nError:\n%v\n", templateContents, err))
+		return "", err
 	}
 
-	// Execute the template
-	var buf bytes.Buffer
-	err = t.Execute(&buf, resourceMap)
+	result, err := certutil.FormatPemPrivateKey(key, certutil.KeyFormat(format), passphrase)
 	if err != nil {
-		panic(fmt.Sprintf("Error executing template: %v Error: %v", templateContents, err))
+		return "", fmt.Errorf("secret %v: %w", secret.Name, err)
+	}
+
+	return result, nil
+}
+
+// Encrypts the private key with the passphrase, unless the sink already holds the same key encrypted with it.
+// Each encryption uses a fresh salt and IV, so without this the sink would be rewritten every cycle
+func encryptedPrivateKeyFromSecret(secret secrets.Secret, passphrase string, sinkPath string) (string, error) {
+	if sinkPath != "" {
+		if previous, err := ioutil.ReadFile(sinkPath); err == nil {
+			key, err := privateKeyFromSecret(secret)
+			if err != nil {
+				return "", err
+			}
+			if block, ok := certutil.FindEncryptedPrivateKey(string(previous), key, passphrase); ok {
+				return block, nil
+			}
+		}
 	}
 
-	result := buf.String()
+	return formattedPrivateKeyFromSecret(secret, string(certutil.Pkcs8KeyFormat), passphrase)
+}
 
-	return result
+func certFromSecret(secret secrets.Secret) (string, error) {
+	return fromSecret(secret, certutil.PemCertFromPem, certutil.PemCertFromPkcs12)
 }
 
-func certFromSecret(secret secrets.Secret) string {
+func chainFromSecret(secret secrets.Secret, justIssuers bool, completer *certutil.ChainCompleter) (string, error) {
+	return fromSecret(secret,
+		func(data string) (string, error) { return certutil.PemChainFromPem(data, justIssuers, completer) },
+		func(data string, password string) (string, error) {
+			return certutil.PemChainFromPkcs12(data, password, justIssuers, completer)
+		},
+	)
+}
+
+// One chain completer per chainCompletion config, so the CA bundle is read once rather than on every render
+var completers = struct {
+	sync.Mutex
+	byConfig map[config.ChainCompletionConfig]*certutil.ChainCompleter
+}{byConfig: make(map[config.ChainCompletionConfig]*certutil.ChainCompleter)}
+
+// Returns the chain completer for the sink's chainCompletion config, or nil if it is not enabled
+func chainCompleter(chainCompletion config.ChainCompletionConfig) *certutil.ChainCompleter {
+	if chainCompletion.CABundleDir == "" && !chainCompletion.FetchAIA {
+		return nil
+	}
+
+	completers.Lock()
+	defer completers.Unlock()
+
+	completer, ok := completers.byConfig[chainCompletion]
+	if !ok {
+		completer = &certutil.ChainCompleter{
+			BundleDir:  chainCompletion.CABundleDir,
+			FetchAIA:   chainCompletion.FetchAIA,
+			CacheDir:   chainCompletion.CacheDir,
+			HTTPClient: &http.Client{Timeout: chainCompletion.TimeTimeout},
+		}
+		completers.byConfig[chainCompletion] = completer
+	}
+
+	return completer
+}
+
+// Returns a copy of the secret that decodes with the given PKCS12 password
+func withPfxPassword(secret secrets.Secret, password string) secrets.Secret {
+	secret.PfxPassword = password
+	return secret
+}
+
+// Picks the PEM or PKCS12 conversion based on the secret's content type, naming the secret in any error
+func fromSecret(secret secrets.Secret, fromPem func(string) (string, error), fromPkcs12 func(string, string) (string, error)) (string, error) {
+	if secret.ContentType == nil {
+		return "", fmt.Errorf("secret %v: has no content type", secret.Name)
+	}
+	if secret.Value == nil {
+		return "", fmt.Errorf("secret %v: has no value", secret.Name)
+	}
+
+	var result string
+	var err error
 	switch contentType := *secret.ContentType; contentType {
 	case "application/x-pem-file":
-		return certutil.PemCertFromPem(*secret.Value)
+		result, err = fromPem(*secret.Value)
 	case "application/x-pkcs12":
-		return certutil.PemCertFromPkcs12(*secret.Value)
+		result, err = fromPkcs12(*secret.Value, secret.PfxPassword)
 	default:
-		panic(fmt.Sprintf("Got unexpected content type: %v", contentType))
+		return "", fmt.Errorf("secret %v: got unexpected content type: %v", secret.Name, contentType)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("secret %v: %w", secret.Name, err)
+	}
+
+	return result, nil
+}
+
+// Extracts the certificate name from its identifier like https://vault/certificates/<name>/<version>
+func certName(cert certs.Cert) string {
+	if cert.ID == nil {
+		return ""
 	}
+
+	parts := strings.Split(*cert.ID, "/certificates/")
+	if len(parts) != 2 {
+		return *cert.ID
+	}
+
+	return strings.Split(parts[1], "/")[0]
 }
 
 func cloneSecret(secret secrets.Secret, parsedItem string) secrets.Secret {
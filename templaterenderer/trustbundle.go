@@ -0,0 +1,94 @@
+package templaterenderer
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/covermymeds/azure-key-vault-agent/certs"
+	"github.com/covermymeds/azure-key-vault-agent/certutil"
+	"github.com/covermymeds/azure-key-vault-agent/secrets"
+)
+
+// Collects every certificate from the given certs and secrets, or maps of them, into one deduplicated PEM bundle
+func trustBundle(dropExpired bool, items ...interface{}) (string, error) {
+	var found []*x509.Certificate
+	for _, item := range items {
+		switch t := item.(type) {
+		case certs.Cert:
+			results, err := certsFromCert(t)
+			if err != nil {
+				return "", err
+			}
+			found = append(found, results...)
+		case secrets.Secret:
+			results, err := certsFromSecret(t, false)
+			if err != nil {
+				return "", err
+			}
+			found = append(found, results...)
+		case map[string]certs.Cert:
+			for _, cert := range t {
+				results, err := certsFromCert(cert)
+				if err != nil {
+					return "", err
+				}
+				found = append(found, results...)
+			}
+		case map[string]secrets.Secret:
+			// A map is usually all-secrets, so skip the secrets that aren't certificates
+			for _, secret := range t {
+				results, err := certsFromSecret(secret, true)
+				if err != nil {
+					return "", err
+				}
+				found = append(found, results...)
+			}
+		default:
+			return "", fmt.Errorf("got unexpected type: %T", item)
+		}
+	}
+
+	return certutil.PemTrustBundle(found, dropExpired, time.Now())
+}
+
+func certsFromCert(cert certs.Cert) ([]*x509.Certificate, error) {
+	if cert.Cer == nil {
+		return nil, fmt.Errorf("cert %v: %w", certName(cert), certutil.ErrNoCertificate)
+	}
+
+	parsed, err := x509.ParseCertificate(*cert.Cer)
+	if err != nil {
+		return nil, fmt.Errorf("cert %v: %w: %v", certName(cert), certutil.ErrInvalidPem, err)
+	}
+
+	return []*x509.Certificate{parsed}, nil
+}
+
+// Returns all the certificates in a PEM or PKCS12 secret. With skipOthers, other secrets give none
+func certsFromSecret(secret secrets.Secret, skipOthers bool) ([]*x509.Certificate, error) {
+	if skipOthers && (secret.ContentType == nil ||
+		(*secret.ContentType != "application/x-pem-file" && *secret.ContentType != "application/x-pkcs12")) {
+		return nil, nil
+	}
+
+	var found []*x509.Certificate
+	_, err := fromSecret(secret,
+		func(data string) (string, error) {
+			var err error
+			found, err = certutil.CertsFromPem(data)
+			return "", err
+		},
+		func(data string, password string) (string, error) {
+			var err error
+			found, err = certutil.CertsFromPkcs12(data, password)
+			return "", err
+		},
+	)
+	if err != nil && !(skipOthers && errors.Is(err, certutil.ErrNoCertificate)) {
+		return nil, err
+	}
+
+	return found, nil
+}
@@ -0,0 +1,191 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/covermymeds/azure-key-vault-agent/certs"
+	"github.com/covermymeds/azure-key-vault-agent/client"
+	"github.com/covermymeds/azure-key-vault-agent/config"
+	"github.com/covermymeds/azure-key-vault-agent/diskcache"
+	"github.com/covermymeds/azure-key-vault-agent/keys"
+	"github.com/covermymeds/azure-key-vault-agent/secrets"
+)
+
+// The last value fetched for each resource with onError: stale, and the vault it came from. It outlives the
+// worker, so a config reload doesn't lose it
+var lastFetched = struct {
+	sync.Mutex
+	values map[string]fetched
+}{values: make(map[string]fetched)}
+
+type fetched struct {
+	value  interface{}
+	source string
+}
+
+// The on-disk cache from the top-level cache option, if it is configured
+var diskCache = struct {
+	sync.Mutex
+	cache *diskcache.Cache
+}{}
+
+// Sets the on-disk cache every worker falls back to once its vaults and fallbacks fail. nil turns it off
+func UseCache(cache *diskcache.Cache) {
+	diskCache.Lock()
+	defer diskCache.Unlock()
+	diskCache.cache = cache
+}
+
+func currentCache() *diskcache.Cache {
+	diskCache.Lock()
+	defer diskCache.Unlock()
+	return diskCache.cache
+}
+
+// Writes out what this cycle put in the on-disk cache
+func flushCache() {
+	if cache := currentCache(); cache != nil {
+		if err := cache.Flush(); err != nil {
+			log.Printf("Error writing cache: %v", err)
+		}
+	}
+}
+
+// A pointer to the type fetched for resources of the kind, to decode cached values into
+func cachedValue(kind config.ResourceKind) interface{} {
+	switch kind {
+	case config.CertKind:
+		return &certs.Cert{}
+	case config.AllCertsKind:
+		return &map[string]certs.Cert{}
+	case config.KeyKind:
+		return &keys.Key{}
+	case config.AllKeysKind:
+		return &map[string]keys.Key{}
+	case config.SecretKind, config.CyberarkSecretKind:
+		return &secrets.Secret{}
+	case config.AllSecretsKind, config.AllCyberarkSecretsKind:
+		return &map[string]secrets.Secret{}
+	default:
+		return &[]secrets.Secret{}
+	}
+}
+
+// Identifies a resource by everything that decides what it fetches
+func resourceKey(resourceConfig config.ResourceConfig) string {
+	return fmt.Sprintf("%v %v %v %v %v %v %+v",
+		resourceConfig.GetKind(),
+		resourceConfig.GetCredential(),
+		resourceConfig.GetVault(),
+		resourceConfig.GetName(),
+		resourceConfig.GetVersion(),
+		resourceConfig.GetVersionCount(),
+		resourceConfig.GetSecretFilter())
+}
+
+// A throttled or unreachable vault, as opposed to one that answered with an error. A request cut short by the
+// cycle's deadline counts too; the Key Vault client's errors don't unwrap to the context's, so ctx is checked itself
+func isUnavailable(ctx context.Context, err error) bool {
+	return errors.Is(err, client.ErrThrottled) || errors.Is(err, client.ErrTransient) ||
+		errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded
+}
+
+// Runs fetch against the resource's vault, then its fallbackVaults in order while each is unavailable, and applies
+// the resource's optional and onError options and the on-disk cache to the result. source is the vault that served
+// the value. A nil value without an error means an optional resource was not found. stale is set when the last value
+// fetched stands in for a failed request
+func fetchWithPolicy(ctx context.Context, clients client.Clients, resourceConfig config.ResourceConfig, fetch func(c client.Client, vault string) (interface{}, error)) (value interface{}, source string, stale bool, err error) {
+	failure := resourceConfig.GetFailure()
+	key := resourceKey(resourceConfig)
+
+	source = resourceConfig.GetVault()
+	value, err = fetch(clients[resourceConfig.GetCredential()], source)
+	for _, fallback := range resourceConfig.GetFallbackVaults() {
+		// Every vault shares the cycle's deadline, so there is no time left to try the others
+		if err == nil || !isUnavailable(ctx, err) || ctx.Err() != nil {
+			break
+		}
+		log.WithFields(log.Fields{
+			"event":    "fallback",
+			"kind":     resourceConfig.GetKind(),
+			"name":     resourceConfig.GetName(),
+			"vault":    source,
+			"fallback": fallback.GetVault(),
+		}).Warnf("Trying %v for %v %v: %v", fallback.GetVault(), resourceConfig.GetKind(), resourceConfig.GetName(), err)
+
+		source = fallback.GetVault()
+		value, err = fetch(clients[fallback.Credential], source)
+	}
+
+	if err == nil {
+		if source != resourceConfig.GetVault() {
+			log.WithFields(log.Fields{
+				"event":  "served",
+				"kind":   resourceConfig.GetKind(),
+				"name":   resourceConfig.GetName(),
+				"source": source,
+			}).Printf("Fetched %v %v from fallback %v", resourceConfig.GetKind(), resourceConfig.GetName(), source)
+		}
+		if failure.OnError == config.StaleOnError {
+			lastFetched.Lock()
+			lastFetched.values[key] = fetched{value: value, source: source}
+			lastFetched.Unlock()
+		}
+		if cache := currentCache(); cache != nil {
+			if err := cache.Put(key, value, source); err != nil {
+				log.Printf("Error caching %v %v: %v", resourceConfig.GetKind(), resourceConfig.GetName(), err)
+			}
+		}
+		return value, source, false, nil
+	}
+
+	if failure.Optional && errors.Is(err, client.ErrNotFound) {
+		log.Printf("Optional %v %v not found in %v", resourceConfig.GetKind(), resourceConfig.GetName(), source)
+		return nil, "", false, nil
+	}
+
+	if failure.OnError == config.StaleOnError && isUnavailable(ctx, err) {
+		lastFetched.Lock()
+		previous, ok := lastFetched.values[key]
+		lastFetched.Unlock()
+
+		if ok {
+			log.WithFields(log.Fields{
+				"event":  "stale",
+				"kind":   resourceConfig.GetKind(),
+				"name":   resourceConfig.GetName(),
+				"vault":  resourceConfig.GetVault(),
+				"source": previous.source,
+			}).Warnf("Using the last value fetched for %v %v: %v", resourceConfig.GetKind(), resourceConfig.GetName(), err)
+			return previous.value, previous.source, true, nil
+		}
+	}
+
+	if cache := currentCache(); cache != nil && isUnavailable(ctx, err) {
+		cached := cachedValue(resourceConfig.GetKind())
+		cachedSource, fetchedAt, cacheErr := cache.Get(key, cached)
+		if cacheErr != nil && !errors.Is(cacheErr, diskcache.ErrNotCached) {
+			log.Printf("Not using cached %v %v: %v", resourceConfig.GetKind(), resourceConfig.GetName(), cacheErr)
+		}
+		if cacheErr == nil {
+			log.WithFields(log.Fields{
+				"event":  "cache",
+				"kind":   resourceConfig.GetKind(),
+				"name":   resourceConfig.GetName(),
+				"vault":  resourceConfig.GetVault(),
+				"source": cachedSource,
+				"age":    time.Since(fetchedAt).Round(time.Second),
+			}).Warnf("Served %v %v from cache, fetched at %v: %v", resourceConfig.GetKind(), resourceConfig.GetName(), fetchedAt, err)
+			return reflect.ValueOf(cached).Elem().Interface(), cachedSource, true, nil
+		}
+	}
+
+	return nil, "", false, err
+}
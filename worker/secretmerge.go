@@ -0,0 +1,80 @@
+package worker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/covermymeds/azure-key-vault-agent/config"
+	"github.com/covermymeds/azure-key-vault-agent/secrets"
+)
+
+// Builds .Secrets from the worker's resources in the order they are configured, so a later vault can be layered
+// over an earlier one. A key provided by two resources is resolved by the worker's secretConflicts policy
+type secretMerger struct {
+	policy  config.ConflictPolicy
+	secrets map[string]secrets.Secret
+	// The resource each key came from
+	sources map[string]*config.ResourceConfig
+}
+
+func newSecretMerger(policy config.ConflictPolicy) *secretMerger {
+	if policy == "" {
+		policy = config.LastWins
+	}
+	return &secretMerger{
+		policy:  policy,
+		secrets: make(map[string]secrets.Secret),
+		sources: make(map[string]*config.ResourceConfig),
+	}
+}
+
+// Adds a secret from a single secret resource under its name and alias
+func (m *secretMerger) addSecret(resourceConfig *config.ResourceConfig, secret secrets.Secret) error {
+	if err := m.add(resourceConfig, resourceConfig.GetName(), secret); err != nil {
+		return err
+	}
+	if resourceConfig.GetAlias() != "" {
+		return m.add(resourceConfig, resourceConfig.GetAlias(), secret)
+	}
+	return nil
+}
+
+// Adds the secrets from an all-secrets resource, applying its stripPrefix and keyPrefix options to the keys
+func (m *secretMerger) addAll(resourceConfig *config.ResourceConfig, items map[string]secrets.Secret) error {
+	filter := resourceConfig.GetSecretFilter()
+	for name, secret := range items {
+		key := name
+		if filter.StripPrefix {
+			key = strings.TrimPrefix(key, filter.Prefix)
+		}
+		key = filter.KeyPrefix + key
+
+		if err := m.add(resourceConfig, key, secret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *secretMerger) add(resourceConfig *config.ResourceConfig, key string, secret secrets.Secret) error {
+	if source, ok := m.sources[key]; ok && source != resourceConfig {
+		switch m.policy {
+		case config.ErrorOnConflict:
+			return fmt.Errorf("secret %v is provided by both %v and %v, set secretConflicts or keyPrefix to resolve this",
+				key, describeResource(source), describeResource(resourceConfig))
+		case config.FirstWins:
+			return nil
+		}
+	}
+
+	m.secrets[key] = secret
+	m.sources[key] = resourceConfig
+	return nil
+}
+
+func describeResource(resourceConfig *config.ResourceConfig) string {
+	if resourceConfig.GetName() == "" {
+		return fmt.Sprintf("%v %v", resourceConfig.GetKind(), resourceConfig.GetVault())
+	}
+	return fmt.Sprintf("%v %v/%v", resourceConfig.GetKind(), resourceConfig.GetVault(), resourceConfig.GetName())
+}
@@ -0,0 +1,115 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/covermymeds/azure-key-vault-agent/certs"
+	"github.com/covermymeds/azure-key-vault-agent/client"
+	"github.com/covermymeds/azure-key-vault-agent/config"
+	"github.com/covermymeds/azure-key-vault-agent/secrets"
+)
+
+// Applies the resource's onExpired, respectNotBefore and expiryWarningDays options to a fetched secret,
+// returning the version that should be used
+func checkSecretValidity(ctx context.Context, c client.Client, vault string, resourceConfig config.ResourceConfig, secret secrets.Secret) (secrets.Secret, error) {
+	validity := resourceConfig.GetValidity()
+	now := time.Now()
+
+	if secret.Enabled != nil && !*secret.Enabled {
+		return secrets.Secret{}, fmt.Errorf("secret %v is disabled", secret.Name)
+	}
+
+	if validity.RespectNotBefore && secret.NotBefore != nil && now.Before(*secret.NotBefore) {
+		if resourceConfig.GetVersion() != "" {
+			return secrets.Secret{}, fmt.Errorf("secret %v version %v is not valid until %v", secret.Name, secret.Version, *secret.NotBefore)
+		}
+		previous, err := previousSecretVersion(ctx, c, vault, secret, now)
+		if err != nil {
+			return secrets.Secret{}, err
+		}
+		log.Printf("Secret %v version %v is not valid until %v, using version %v", secret.Name, secret.Version, *secret.NotBefore, previous.Version)
+		secret = previous
+	}
+
+	if err := checkExpiry(validity, "secret", secret.Name, secret.Expires, now); err != nil {
+		return secrets.Secret{}, err
+	}
+
+	return secret, nil
+}
+
+// Applies the resource's onExpired and expiryWarningDays options to a fetched cert
+func checkCertValidity(resourceConfig config.ResourceConfig, name string, cert certs.Cert) error {
+	if cert.Attributes == nil {
+		return nil
+	}
+
+	if cert.Attributes.Enabled != nil && !*cert.Attributes.Enabled {
+		return fmt.Errorf("cert %v is disabled", name)
+	}
+
+	var expires *time.Time
+	if cert.Attributes.Expires != nil {
+		t := time.Time(*cert.Attributes.Expires)
+		expires = &t
+	}
+
+	return checkExpiry(resourceConfig.GetValidity(), "cert", name, expires, time.Now())
+}
+
+// Fails, warns about or allows an expired resource, and logs an expiring event within the warning window.
+// The events carry an event field so they can be counted from the logs
+func checkExpiry(validity config.ValidityConfig, kind string, name string, expires *time.Time, now time.Time) error {
+	if expires == nil {
+		return nil
+	}
+
+	fields := log.Fields{"kind": kind, "name": name, "expires": *expires}
+
+	if now.After(*expires) {
+		switch validity.OnExpired {
+		case config.FailOnExpired:
+			return fmt.Errorf("%v %v expired at %v", kind, name, *expires)
+		case config.AllowOnExpired:
+			return nil
+		default:
+			fields["event"] = "expired"
+			log.WithFields(fields).Warnf("%v %v expired at %v", kind, name, *expires)
+			return nil
+		}
+	}
+
+	window := time.Duration(validity.ExpiryWarningDays) * 24 * time.Hour
+	if window > 0 && expires.Sub(now) < window {
+		daysLeft := int(expires.Sub(now).Hours() / 24)
+		fields["event"] = "expiring"
+		fields["daysLeft"] = daysLeft
+		log.WithFields(fields).Warnf("%v %v expires in %v days", kind, name, daysLeft)
+	}
+
+	return nil
+}
+
+// Fetches the newest enabled version of the secret that is already valid
+func previousSecretVersion(ctx context.Context, c client.Client, vault string, secret secrets.Secret, now time.Time) (secrets.Secret, error) {
+	versions, err := c.GetSecretVersions(ctx, vault, secret.Name)
+	if err != nil {
+		return secrets.Secret{}, err
+	}
+
+	for _, version := range versions {
+		if version.Version == secret.Version || (version.Enabled != nil && !*version.Enabled) {
+			continue
+		}
+		if version.NotBefore != nil && now.Before(*version.NotBefore) {
+			continue
+		}
+		return c.GetSecret(ctx, vault, secret.Name, version.Version)
+	}
+
+	return secrets.Secret{}, fmt.Errorf("secret %v is not valid until %v and has no earlier version that is", secret.Name, *secret.NotBefore)
+}
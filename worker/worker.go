@@ -7,12 +7,14 @@ import (
 	"os"
 	"os/exec"
 	"reflect"
+	"sync"
 	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/covermymeds/azure-key-vault-agent/certs"
+	"github.com/covermymeds/azure-key-vault-agent/certutil"
 	"github.com/covermymeds/azure-key-vault-agent/client"
 	"github.com/covermymeds/azure-key-vault-agent/config"
 	"github.com/covermymeds/azure-key-vault-agent/keys"
@@ -25,6 +27,44 @@ import (
 
 const RetryBreakPoint = 60
 
+// How many times a sink is dry rendered while discovering dynamic resources, so templates
+// that look up secrets by the value of other secrets still terminate
+const MaxDynamicRenders = 10
+
+// Secrets fetched for dynamicResources with cacheFor set. Like lastFetched, it outlives the worker
+var dynamicValues = struct {
+	sync.Mutex
+	values map[string]dynamicValue
+}{values: make(map[string]dynamicValue)}
+
+type dynamicValue struct {
+	secret    secrets.Secret
+	fetchedAt time.Time
+}
+
+// The secrets each sink's template requested on its last cycle, by sink path
+var sinkDependencies = struct {
+	sync.Mutex
+	dependencies map[string][]templaterenderer.Dependency
+}{dependencies: make(map[string][]templaterenderer.Dependency)}
+
+func rememberedDependencies(path string) []templaterenderer.Dependency {
+	sinkDependencies.Lock()
+	defer sinkDependencies.Unlock()
+	return sinkDependencies.dependencies[path]
+}
+
+func rememberDependencies(path string, requested map[templaterenderer.Dependency]bool) {
+	var dependencies []templaterenderer.Dependency
+	for dependency := range requested {
+		dependencies = append(dependencies, dependency)
+	}
+
+	sinkDependencies.Lock()
+	defer sinkDependencies.Unlock()
+	sinkDependencies.dependencies[path] = dependencies
+}
+
 func Worker(ctx context.Context, clients client.Clients, workerConfig config.WorkerConfig) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -80,83 +120,232 @@ func Worker(ctx context.Context, clients client.Clients, workerConfig config.Wor
 }
 
 func Process(ctx context.Context, clients client.Clients, workerConfig config.WorkerConfig) error {
+	if workerConfig.TimeCycleTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, workerConfig.TimeCycleTimeout)
+		defer cancel()
+	}
+
+	resources := resource.ResourceMap{
+		Certs:   make(map[string]certs.Cert),
+		Secrets: make(map[string]secrets.Secret),
+		Keys:    make(map[string]keys.Key),
+
+		SecretVersions: make(map[string][]secrets.Secret),
+		Stale: resource.StaleMap{
+			Certs:          make(map[string]bool),
+			Secrets:        make(map[string]bool),
+			Keys:           make(map[string]bool),
+			SecretVersions: make(map[string]bool),
+		},
+		Sources: resource.SourceMap{
+			Certs:          make(map[string]string),
+			Secrets:        make(map[string]string),
+			Keys:           make(map[string]string),
+			SecretVersions: make(map[string]string),
+		},
+	}
 
-	resources := resource.ResourceMap{make(map[string]certs.Cert), make(map[string]secrets.Secret), make(map[string]keys.Key)}
+	// Keep whatever was fetched, even if a later resource fails the cycle
+	defer flushCache()
 
-	for _, resourceConfig := range workerConfig.Resources {
+	merger := newSecretMerger(workerConfig.SecretConflicts)
+	for i, resourceConfig := range workerConfig.Resources {
 		c := clients[resourceConfig.GetCredential()]
 		switch resourceConfig.GetKind() {
 		case config.CertKind:
-			result, err := c.GetCert(resourceConfig.GetVault(), resourceConfig.GetName(), resourceConfig.GetVersion())
+			value, source, stale, err := fetchWithPolicy(ctx, clients, resourceConfig, func(c client.Client, vault string) (interface{}, error) {
+				result, err := c.GetCert(ctx, vault, resourceConfig.GetName(), resourceConfig.GetVersion())
+				if err != nil {
+					return nil, err
+				}
+				if err := checkCertValidity(resourceConfig, resourceConfig.GetName(), result); err != nil {
+					return nil, err
+				}
+				return result, nil
+			})
 			if err != nil {
 				return err
 			}
+			if value == nil {
+				continue
+			}
+			result := value.(certs.Cert)
 			resources.Certs[resourceConfig.GetName()] = result
 			if resourceConfig.GetAlias() != "" {
 				resources.Certs[resourceConfig.GetAlias()] = result
 			}
+			markFetched(resources.Stale.Certs, resources.Sources.Certs, source, stale, resourceConfig.GetName(), resourceConfig.GetAlias())
 
-		case config.SecretKind:
-			result, err := c.GetSecret(resourceConfig.GetVault(), resourceConfig.GetName(), resourceConfig.GetVersion())
+		case config.SecretKind, config.CyberarkSecretKind:
+			value, source, stale, err := fetchWithPolicy(ctx, clients, resourceConfig, func(c client.Client, vault string) (interface{}, error) {
+				result, err := c.GetSecret(ctx, vault, resourceConfig.GetName(), resourceConfig.GetVersion())
+				if err != nil {
+					return nil, err
+				}
+				result, err = checkSecretValidity(ctx, c, vault, resourceConfig, result)
+				if err != nil {
+					return nil, err
+				}
+				return fetchPfxPassword(ctx, c, vault, resourceConfig, result)
+			})
 			if err != nil {
 				return err
 			}
-			resources.Secrets[resourceConfig.GetName()] = result
-			if resourceConfig.GetAlias() != "" {
-				resources.Secrets[resourceConfig.GetAlias()] = result
+			if value == nil {
+				defaultValue := resourceConfig.GetFailure().Default
+				if defaultValue == nil {
+					continue
+				}
+				value = secrets.Secret{Name: resourceConfig.GetName(), Value: defaultValue}
+			}
+			result := value.(secrets.Secret)
+			result.Source = source
+			result.Stale = stale
+			if err := merger.addSecret(&workerConfig.Resources[i], result); err != nil {
+				return err
 			}
 
-		case config.AllSecretsKind:
-			result, err := c.GetSecrets(resourceConfig.GetVault())
+		case config.AllSecretsKind, config.AllCyberarkSecretsKind:
+			value, source, stale, err := fetchWithPolicy(ctx, clients, resourceConfig, func(c client.Client, vault string) (interface{}, error) {
+				result, err := c.GetSecrets(ctx, vault, resourceConfig.GetSecretFilter())
+				if err != nil {
+					return nil, err
+				}
+				for key, secret := range result {
+					result[key], err = checkSecretValidity(ctx, c, vault, resourceConfig, secret)
+					if err != nil {
+						return nil, err
+					}
+				}
+				return result, nil
+			})
 			if err != nil {
 				return err
 			}
-			resources.Secrets = result
+			if value == nil {
+				continue
+			}
+			result := make(map[string]secrets.Secret)
+			for key, secret := range value.(map[string]secrets.Secret) {
+				secret.Source = source
+				secret.Stale = stale
+				result[key] = secret
+			}
+			if err := merger.addAll(&workerConfig.Resources[i], result); err != nil {
+				return err
+			}
+
+		case config.AllCertsKind:
+			value, source, stale, err := fetchWithPolicy(ctx, clients, resourceConfig, func(c client.Client, vault string) (interface{}, error) {
+				result, err := c.GetCerts(ctx, vault)
+				if err != nil {
+					return nil, err
+				}
+				for name, cert := range result {
+					if err := checkCertValidity(resourceConfig, name, cert); err != nil {
+						return nil, err
+					}
+				}
+				return result, nil
+			})
+			if err != nil {
+				return err
+			}
+			if value == nil {
+				continue
+			}
+			// Copied, as the map may be kept for onError: stale
+			for name, cert := range value.(map[string]certs.Cert) {
+				resources.Certs[name] = cert
+				markFetched(resources.Stale.Certs, resources.Sources.Certs, source, stale, name)
+			}
 
 		case config.KeyKind:
-			result, err := c.GetKey(resourceConfig.GetVault(), resourceConfig.GetName(), resourceConfig.GetVersion())
+			value, source, stale, err := fetchWithPolicy(ctx, clients, resourceConfig, func(c client.Client, vault string) (interface{}, error) {
+				return c.GetKey(ctx, vault, resourceConfig.GetName(), resourceConfig.GetVersion())
+			})
 			if err != nil {
 				return err
 			}
+			if value == nil {
+				continue
+			}
+			result := value.(keys.Key)
 			resources.Keys[resourceConfig.GetName()] = result
 			if resourceConfig.GetAlias() != "" {
 				resources.Keys[resourceConfig.GetAlias()] = result
 			}
+			markFetched(resources.Stale.Keys, resources.Sources.Keys, source, stale, resourceConfig.GetName(), resourceConfig.GetAlias())
 
-		case config.AllCyberarkSecretsKind:
-			result, err := c.GetSecrets(resourceConfig.GetVault())
+		case config.AllKeysKind:
+			value, source, stale, err := fetchWithPolicy(ctx, clients, resourceConfig, func(c client.Client, vault string) (interface{}, error) {
+				return c.GetKeys(ctx, vault)
+			})
 			if err != nil {
 				return err
 			}
-			resources.Secrets = result
+			if value == nil {
+				continue
+			}
+			for name, key := range value.(map[string]keys.Key) {
+				resources.Keys[name] = key
+				markFetched(resources.Stale.Keys, resources.Sources.Keys, source, stale, name)
+			}
 
-		case config.CyberarkSecretKind:
-			result, err := c.GetSecret(resourceConfig.GetVault(), resourceConfig.GetName(), resourceConfig.GetVersion())
+		case config.SecretVersionsKind, config.CyberarkVersionsKind:
+			value, source, stale, err := fetchWithPolicy(ctx, clients, resourceConfig, func(c client.Client, vault string) (interface{}, error) {
+				return fetchSecretVersions(ctx, c, vault, resourceConfig)
+			})
 			if err != nil {
 				return err
 			}
-			resources.Secrets[resourceConfig.GetName()] = result
+			if value == nil {
+				continue
+			}
+			result := value.([]secrets.Secret)
+			resources.SecretVersions[resourceConfig.GetName()] = result
 			if resourceConfig.GetAlias() != "" {
-				resources.Secrets[resourceConfig.GetAlias()] = result
+				resources.SecretVersions[resourceConfig.GetAlias()] = result
 			}
+			markFetched(resources.Stale.SecretVersions, resources.Sources.SecretVersions, source, stale, resourceConfig.GetName(), resourceConfig.GetAlias())
 
 		default:
 			panic(fmt.Sprintf("Invalid resource kind: %v for credential type %v", resourceConfig.GetKind(), reflect.TypeOf(c)))
 		}
 	}
 
+	resources.Secrets = merger.secrets
+	for key, secret := range resources.Secrets {
+		markFetched(resources.Stale.Secrets, resources.Sources.Secrets, secret.Source, secret.Stale, key)
+	}
+
+	var dynamic *templaterenderer.DynamicSecrets
+	if workerConfig.DynamicResources.Enabled {
+		var err error
+		dynamic, err = fetchDynamicResources(ctx, clients, workerConfig, resources)
+		if err != nil {
+			return err
+		}
+	}
+
 	type Change struct {
 		sinkConfig  config.SinkConfig
 		newContents string
 	}
 
 	var changes []Change
+	rendered := make(map[string]string)
 	for _, sinkConfig := range workerConfig.Sinks {
 		// Get old content
 		oldContents := getOldContent(sinkConfig)
 
 		// Get new content
-		newContents := getNewContent(sinkConfig, resources)
+		newContents, err := getNewContent(sinkConfig, resources, dynamic)
+		if err != nil {
+			return fmt.Errorf("rendering %v: %w", sinkConfig.Path, err)
+		}
+		rendered[sinkConfig.Path] = newContents
 
 		// Detect if ownership or mode has changed
 		fileAttributesChanged := getFileAttributesChanged(sinkConfig)
@@ -168,6 +357,12 @@ func Process(ctx context.Context, clients client.Clients, workerConfig config.Wo
 		}
 	}
 
+	if len(changes) > 0 && workerConfig.TLSCheck.Enabled {
+		if err := checkTLS(workerConfig.TLSCheck, workerConfig.Sinks, rendered); err != nil {
+			return fmt.Errorf("tlsCheck failed, not writing any sinks: %w", err)
+		}
+	}
+
 	if len(changes) > 0 {
 		if workerConfig.PreChange != "" {
 			err := runCommand(workerConfig.PreChange)
@@ -191,21 +386,277 @@ func Process(ctx context.Context, clients client.Clients, workerConfig config.Wo
 	return nil
 }
 
-func getNewContent(sinkConfig config.SinkConfig, resources resource.ResourceMap) string {
+func getNewContent(sinkConfig config.SinkConfig, resources resource.ResourceMap, dynamic *templaterenderer.DynamicSecrets) (string, error) {
 	// If we have templates get the new value from rendering them
 	if sinkConfig.Template != "" || sinkConfig.TemplatePath != "" {
 		if sinkConfig.Template != "" {
 			// Execute inline template
-			return templaterenderer.RenderInline(sinkConfig.Template, resources)
+			return templaterenderer.RenderInline(sinkConfig.Template, sinkConfig, resources, dynamic)
 		} else {
 			// Execute template file
-			return templaterenderer.RenderFile(sinkConfig.TemplatePath, resources)
+			return templaterenderer.RenderFile(sinkConfig.TemplatePath, sinkConfig, resources, dynamic)
 		}
+	} else if sinkConfig.Format != "" {
+		// Serialize the secrets directly
+		return templaterenderer.RenderFormat(sinkConfig, resources)
 	} else {
 		// Just return the string
 		// TODO: If there is only one resource being requested, call .String() on it
-		return "TODO"
+		return "TODO", nil
+	}
+}
+
+// Checks the certificate and key about to be written belong together, are in their validity period and chain to the trust store
+func checkTLS(tlsCheck config.TLSCheckConfig, sinks []config.SinkConfig, rendered map[string]string) error {
+	certPath := findSink(tlsCheck.CertSink, sinks, rendered, certutil.HasPemCertificate)
+	if certPath == "" {
+		return fmt.Errorf("no sink contains a certificate")
+	}
+	keyPath := findSink(tlsCheck.KeySink, sinks, rendered, certutil.HasCheckablePrivateKey)
+	if keyPath == "" {
+		return fmt.Errorf("no sink contains an unencrypted private key, set tlsCheck keySink to choose one")
+	}
+
+	certData := rendered[certPath]
+	if tlsCheck.ChainSink != "" {
+		certData += "\n" + rendered[tlsCheck.ChainSink]
+	}
+
+	opts := certutil.KeyPairOptions{SkipChain: tlsCheck.SkipChain}
+	if tlsCheck.TrustStore != "" && !tlsCheck.SkipChain {
+		roots, err := certutil.LoadCertPool(tlsCheck.TrustStore)
+		if err != nil {
+			return err
+		}
+		opts.Roots = roots
+	}
+
+	if err := certutil.VerifyPemKeyPair(certData, rendered[keyPath], opts); err != nil {
+		return fmt.Errorf("checking %v and %v: %w", certPath, keyPath, err)
+	}
+
+	return nil
+}
+
+// Returns the configured sink path, or the first sink whose contents hold what checkTLS is looking for
+func findSink(path string, sinks []config.SinkConfig, rendered map[string]string, holds func(string) bool) string {
+	if path != "" {
+		return path
+	}
+	for _, sinkConfig := range sinks {
+		if holds(rendered[sinkConfig.Path]) {
+			return sinkConfig.Path
+		}
+	}
+	return ""
+}
+
+// Records the vault each resource was fetched from under the names it was stored as, and whether it is stale, in
+// the maps for its kind. A name stored again takes the staleness of its new value
+func markFetched(staleNames map[string]bool, sources map[string]string, source string, stale bool, names ...string) {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		sources[name] = source
+		if stale {
+			staleNames[name] = true
+		} else {
+			delete(staleNames, name)
+		}
+	}
+}
+
+// Fetches the values of the resource's latest enabled versions, newest first
+func fetchSecretVersions(ctx context.Context, c client.Client, vault string, resourceConfig config.ResourceConfig) ([]secrets.Secret, error) {
+	versions, err := c.GetSecretVersions(ctx, vault, resourceConfig.GetName())
+	if err != nil {
+		return nil, err
 	}
+
+	// The current and previous versions, unless count is set
+	count := resourceConfig.GetVersionCount()
+	if count == 0 {
+		count = 2
+	}
+
+	var results []secrets.Secret
+	for _, version := range versions {
+		if len(results) == count {
+			break
+		}
+		if version.Enabled != nil && !*version.Enabled {
+			continue
+		}
+
+		secret, err := c.GetSecret(ctx, vault, resourceConfig.GetName(), version.Version)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, secret)
+	}
+
+	return results, nil
+}
+
+// Attaches the password from the resource's pfxPasswordSecret, fetched from the same vault, so PKCS12 values can be decoded
+func fetchPfxPassword(ctx context.Context, c client.Client, vault string, resourceConfig config.ResourceConfig, secret secrets.Secret) (secrets.Secret, error) {
+	if resourceConfig.GetPfxPasswordSecret() == "" {
+		return secret, nil
+	}
+
+	password, err := c.GetSecret(ctx, vault, resourceConfig.GetPfxPasswordSecret(), "")
+	if err != nil {
+		return secrets.Secret{}, err
+	}
+	if password.Value == nil {
+		return secrets.Secret{}, fmt.Errorf("pfxPasswordSecret %v for %v has no value", resourceConfig.GetPfxPasswordSecret(), resourceConfig.GetName())
+	}
+
+	secret.PfxPassword = *password.Value
+	return secret, nil
+}
+
+// Dry renders each sink to find the secrets its templates request, fetching them until nothing is missing.
+// Each secret is fetched once per cycle, however many sinks use it, and the secrets a sink requested are
+// fetched before its first render on the next cycle.
+func fetchDynamicResources(ctx context.Context, clients client.Clients, workerConfig config.WorkerConfig, resources resource.ResourceMap) (*templaterenderer.DynamicSecrets, error) {
+	dynamic := templaterenderer.NewDynamicSecrets()
+
+	for _, sinkConfig := range workerConfig.Sinks {
+		if sinkConfig.Template == "" && sinkConfig.TemplatePath == "" {
+			continue
+		}
+
+		// Saves a render per secret in the common case where the template hasn't changed what it requests.
+		// A secret the template no longer requests is dropped below, so its errors don't fail the cycle
+		for _, dependency := range rememberedDependencies(sinkConfig.Path) {
+			if _, ok := dynamic.Values[dependency]; ok {
+				continue
+			}
+			secret, err := fetchDependency(ctx, clients, workerConfig.DynamicResources, dependency)
+			if err != nil {
+				log.Printf("Error fetching %v requested by %v last cycle: %v", dependency, sinkConfig.Path, err)
+				continue
+			}
+			dynamic.Values[dependency] = secret
+		}
+
+		for renders := 1; ; renders++ {
+			dynamic.DryRun = true
+			dynamic.Missing = make(map[templaterenderer.Dependency]bool)
+			dynamic.Requested = make(map[templaterenderer.Dependency]bool)
+			renderErr := dryRender(sinkConfig, resources, dynamic)
+
+			missing := dynamic.MissingDependencies()
+			if len(missing) == 0 {
+				// Nothing left to fetch, so any error is a genuine template error
+				if renderErr != nil {
+					return nil, renderErr
+				}
+				rememberDependencies(sinkConfig.Path, dynamic.Requested)
+				break
+			}
+
+			if renders >= MaxDynamicRenders {
+				return nil, fmt.Errorf("template for %v still requested new resources after %v renders", sinkConfig.Path, renders)
+			}
+
+			for _, dependency := range missing {
+				secret, err := fetchDependency(ctx, clients, workerConfig.DynamicResources, dependency)
+				if err != nil {
+					return nil, err
+				}
+				dynamic.Values[dependency] = secret
+			}
+		}
+	}
+
+	dynamic.DryRun = false
+	return dynamic, nil
+}
+
+// Renders a sink without writing it. Helpers are likely to fail on the empty values used for
+// secrets that haven't been fetched yet
+func dryRender(sinkConfig config.SinkConfig, resources resource.ResourceMap, dynamic *templaterenderer.DynamicSecrets) error {
+	_, err := getNewContent(sinkConfig, resources, dynamic)
+	return err
+}
+
+// Fetches a secret requested by a template like a secret resource, so dynamicResources' optional, onError and
+// validity options, the on-disk cache and the cacheFor option all apply to it
+func fetchDependency(ctx context.Context, clients client.Clients, dynamicConfig config.DynamicResourcesConfig, dependency templaterenderer.Dependency) (secrets.Secret, error) {
+	resourceConfig := dependencyResource(dynamicConfig, dependency)
+	if _, ok := clients[resourceConfig.GetCredential()]; !ok {
+		return secrets.Secret{}, fmt.Errorf("no credential for %v, set dynamicResources credential or cyberarkCredential", dependency)
+	}
+
+	key := resourceKey(resourceConfig)
+	if dynamicConfig.TimeCacheFor > 0 {
+		dynamicValues.Lock()
+		cached, ok := dynamicValues.values[key]
+		dynamicValues.Unlock()
+		if ok && time.Since(cached.fetchedAt) < dynamicConfig.TimeCacheFor {
+			return cached.secret, nil
+		}
+	}
+
+	log.Printf("Fetching dynamic resource %v", dependency)
+	value, source, stale, err := fetchWithPolicy(ctx, clients, resourceConfig, func(c client.Client, vault string) (interface{}, error) {
+		result, err := c.GetSecret(ctx, vault, resourceConfig.GetName(), resourceConfig.GetVersion())
+		if err != nil {
+			return nil, err
+		}
+		return checkSecretValidity(ctx, c, vault, resourceConfig, result)
+	})
+	if err != nil {
+		return secrets.Secret{}, err
+	}
+
+	if value == nil {
+		// Missing optional secrets render as empty values, like they do during a dry run
+		empty := ""
+		value = secrets.Secret{Name: dependency.Name, Value: &empty}
+		if dynamicConfig.Default != nil {
+			value = secrets.Secret{Name: dependency.Name, Value: dynamicConfig.Default}
+		}
+	}
+	secret := value.(secrets.Secret)
+	secret.Source = source
+	secret.Stale = stale
+
+	// Stale values are left out, so the next cycle tries the vault again
+	if dynamicConfig.TimeCacheFor > 0 && !stale {
+		dynamicValues.Lock()
+		dynamicValues.values[key] = dynamicValue{secret: secret, fetchedAt: time.Now()}
+		dynamicValues.Unlock()
+	}
+
+	return secret, nil
+}
+
+// The secret resource a template's request stands for
+func dependencyResource(dynamicConfig config.DynamicResourcesConfig, dependency templaterenderer.Dependency) config.ResourceConfig {
+	if dependency.Kind == config.CyberarkSecretKind {
+		return config.ResourceConfig{GenericResource: config.CyberarkResourceConfig{
+			Kind:          config.CyberarkSecretKind,
+			Credential:    dynamicConfig.CyberarkCredential,
+			SafeName:      dependency.Vault,
+			Name:          dependency.Name,
+			Version:       dependency.Version,
+			FailureConfig: dynamicConfig.FailureConfig,
+		}}
+	}
+
+	return config.ResourceConfig{GenericResource: config.KeyvaultResourceConfig{
+		Kind:           config.SecretKind,
+		Credential:     dynamicConfig.Credential,
+		VaultBaseURL:   dependency.Vault,
+		Name:           dependency.Name,
+		Version:        dependency.Version,
+		FailureConfig:  dynamicConfig.FailureConfig,
+		ValidityConfig: dynamicConfig.ValidityConfig,
+	}}
 }
 
 func getOldContent(sinkConfig config.SinkConfig) string {